@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenTTL is how long an issued JWT stays valid before the client has to
+// log in again, and jwtSecret signs and verifies them. Both are set by
+// configureAuth from the resolved Config before the server starts handling
+// requests.
+var tokenTTL = 24 * time.Hour
+var jwtSecret []byte
+
+// configureAuth applies cfg's JWT settings. If cfg.JWTSecret is empty, an
+// ephemeral key is generated and a warning logged, since that's still safe
+// for local/dev use but won't keep existing sessions valid across a
+// restart.
+func configureAuth(cfg Config) {
+	if cfg.JWTTTL > 0 {
+		tokenTTL = cfg.JWTTTL
+	}
+
+	if cfg.JWTSecret != "" {
+		jwtSecret = []byte(cfg.JWTSecret)
+		return
+	}
+
+	log.Println("JWT secret not set, generating an ephemeral key (tokens won't survive a restart)")
+	jwtSecret = make([]byte, 32)
+	if _, err := rand.Read(jwtSecret); err != nil {
+		log.Fatal("Failed to generate ephemeral JWT secret:", err)
+	}
+}
+
+type userIDContextKey struct{}
+
+// User is the subset of the users table exposed over the API.
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// newToken issues a signed JWT for userID, valid for tokenTTL.
+func newToken(userID int) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   strconv.Itoa(userID),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(tokenTTL)),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+}
+
+// userIDFromToken validates tokenString and returns the user id stored in
+// its subject claim.
+func userIDFromToken(tokenString string) (int, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithIssuedAt())
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(claims.Subject)
+}
+
+// requireAuth wraps next so it only runs for requests carrying a valid
+// "Authorization: Bearer <token>" header, stashing the authenticated user
+// id in the request context for next to read back with userIDFromContext.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		token, ok := strings.CutPrefix(authHeader, "Bearer ")
+		if !ok {
+			http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		userID, err := userIDFromToken(token)
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDContextKey{}, userID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// userIDFromContext returns the authenticated user id stashed by
+// requireAuth. It must only be called from handlers reached through
+// requireAuth.
+func userIDFromContext(r *http.Request) int {
+	return r.Context().Value(userIDContextKey{}).(int)
+}
+
+// handleUsers registers a new account.
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if creds.Username == "" || creds.Password == "" {
+		http.Error(w, "username and password are required", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var user User
+	err = db.QueryRow(
+		"INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id, username",
+		creds.Username, string(hash),
+	).Scan(&user.ID, &user.Username)
+
+	if err != nil {
+		http.Error(w, "username already taken", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// handleTokens logs a user in, returning a signed JWT on success.
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var passwordHash string
+	err := db.QueryRow(
+		"SELECT id, password_hash FROM users WHERE username = $1",
+		creds.Username,
+	).Scan(&userID, &passwordHash)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(creds.Password)); err != nil {
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := newToken(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
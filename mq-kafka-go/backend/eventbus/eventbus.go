@@ -0,0 +1,54 @@
+// Package eventbus abstracts "publish this payload somewhere" behind a
+// single Publisher interface, so main.go and the outbox dispatcher don't
+// need to know which broker is backing EVENT_BUS. Only a Kafka driver
+// ships in this module today (it's the only broker client vendored here),
+// but the interface and the kafka://<topic> URL-scheme convention match
+// the other broker variants (mq-rabbit-go, mq-pgmq-go, mq-zero-go), so a
+// rabbit:// or pgmq:// driver can be dropped in behind the same New
+// without touching callers.
+package eventbus
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Publisher sends a payload to topic on whatever broker it wraps.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Close() error
+}
+
+type requestIDKey struct{}
+
+// WithRequestID attaches requestID to ctx so a Publisher implementation
+// that supports broker-native headers (e.g. Kafka) can carry it alongside
+// payload without changing the Publish signature.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID attached by WithRequestID,
+// or "" if none was set.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// New parses busURL's scheme and constructs the matching Publisher.
+// Recognized schemes: "kafka" (e.g. "kafka://game-events", where the host
+// is the default topic new messages are published to).
+func New(busURL string) (Publisher, error) {
+	u, err := url.Parse(busURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EVENT_BUS url %q: %w", busURL, err)
+	}
+
+	switch u.Scheme {
+	case "kafka":
+		return newKafkaPublisher(u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported EVENT_BUS scheme %q (only \"kafka\" is wired up in this variant)", u.Scheme)
+	}
+}
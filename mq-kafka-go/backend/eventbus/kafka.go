@@ -0,0 +1,64 @@
+package eventbus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"gameapi/internal/logging"
+)
+
+// kafkaPublisher publishes to a kafka-go Writer that isn't bound to a
+// fixed topic, so Publish can target whatever topic the caller names
+// (defaultTopic is only the fallback used by the email consumer, which
+// still subscribes to a single topic).
+type kafkaPublisher struct {
+	writer       *kafka.Writer
+	defaultTopic string
+}
+
+func newKafkaPublisher(defaultTopic string) (Publisher, error) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		brokers = "kafka:9092"
+	}
+
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+			Balancer:     &kafka.LeastBytes{},
+			WriteTimeout: 10 * time.Second,
+			ReadTimeout:  10 * time.Second,
+		},
+		defaultTopic: defaultTopic,
+	}, nil
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, topic string, payload []byte) error {
+	if topic == "" {
+		topic = p.defaultTopic
+	}
+
+	message := kafka.Message{
+		Topic: topic,
+		Key:   []byte("game-star-event"),
+		Value: payload,
+		Time:  time.Now(),
+	}
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		message.Headers = []kafka.Header{{Key: logging.RequestIDHeader, Value: []byte(requestID)}}
+	}
+
+	if err := p.writer.WriteMessages(ctx, message); err != nil {
+		return fmt.Errorf("failed to write message to kafka topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
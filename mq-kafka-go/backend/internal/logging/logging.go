@@ -0,0 +1,88 @@
+// Package logging provides a shared JSON slog.Logger and an HTTP
+// middleware that stamps each request with a request ID, so a single
+// request's log lines can be correlated across the HTTP handler, the
+// outbox dispatcher, and (via a Kafka message header) the email consumer.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// RequestIDHeader is the Kafka message header and HTTP response header
+// carrying the request ID, so downstream consumers can pick up the same
+// trace without a shared tracing backend.
+const RequestIDHeader = "request_id"
+
+// New builds a JSON logger whose minimum level is controlled by the
+// LOG_LEVEL environment variable (debug, info, warn, error; defaults to
+// info).
+func New() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: levelFromEnv()}))
+}
+
+func levelFromEnv() slog.Level {
+	switch os.Getenv("LOG_LEVEL") {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Middleware reuses an inbound X-Request-ID header if present, otherwise
+// mints a new one, stashes it on the request context, echoes it back as a
+// response header, and logs the request once it completes.
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get("X-Request-ID")
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+
+			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+			w.Header().Set("X-Request-ID", requestID)
+
+			FromContext(ctx, logger).Info("request", "method", r.Method, "path", r.URL.Path)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequestIDFromContext returns the request ID stashed by Middleware, or
+// "" outside the scope of a request (e.g. in the outbox dispatcher once
+// the HTTP request that enqueued the event has already returned).
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// FromContext returns logger with the request's request_id attached, if
+// any, so call sites don't need to thread the ID through separately.
+func FromContext(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if id := RequestIDFromContext(ctx); id != "" {
+		return logger.With(RequestIDHeader, id)
+	}
+	return logger
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -5,18 +5,23 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/lib/pq"
-	"github.com/segmentio/kafka-go"
+	"github.com/lib/pq"
+
+	"gameapi/eventbus"
+	"gameapi/idempotency"
+	"gameapi/internal/logging"
 )
 
 type Game struct {
@@ -26,11 +31,22 @@ type Game struct {
 	Stars       int    `json:"stars"`
 }
 
+// gameStarEvent is the payload published to the event bus for a star
+// action. It embeds Game so the wire shape stays a flat JSON object, with
+// EventID added so the email consumer can recognize a redelivery of the
+// same event and skip reprocessing it.
+type gameStarEvent struct {
+	Game
+	EventID string `json:"event_id"`
+}
+
 var db *sql.DB
-var kafkaWriter *kafka.Writer
+var publisher eventbus.Publisher
+var logger *slog.Logger
 
 func main() {
 	var err error
+	logger = logging.New()
 
 	// Database setup
 	dbURL := os.Getenv("DATABASE_URL")
@@ -40,14 +56,15 @@ func main() {
 
 	db, err = sql.Open("postgres", dbURL)
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		logger.Error("failed to connect to database", "error", err)
+		os.Exit(1)
 	}
 	defer db.Close()
 
 	// Wait for database
 	for range 120 {
 		if err := db.Ping(); err == nil {
-			log.Println("Connected to database")
+			logger.Info("connected to database")
 			break
 		}
 		time.Sleep(250 * time.Millisecond)
@@ -55,54 +72,181 @@ func main() {
 
 	// Run migrations
 	if err := runMigrations(db); err != nil {
-		log.Fatal("Failed to run migrations:", err)
+		logger.Error("failed to run migrations", "error", err)
+		os.Exit(1)
 	}
 
-	initKafka()
-	defer kafkaWriter.Close()
+	busURL := os.Getenv("EVENT_BUS")
+	if busURL == "" {
+		busURL = "kafka://game-events"
+	}
+	publisher, err = eventbus.New(busURL)
+	if err != nil {
+		logger.Error("failed to construct event bus publisher", "event_bus", busURL, "error", err)
+		os.Exit(1)
+	}
+	defer publisher.Close()
+	logger.Info("event bus publisher initialized", "event_bus", busURL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go outboxDispatcher(ctx)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /api/games", handleGames)
 	mux.HandleFunc("POST /api/games", handleGames)
+	mux.HandleFunc("POST /api/games/bulk", handleBulkGames)
 	mux.HandleFunc("POST /api/games/{id}/star", handleGameActions)
+	mux.HandleFunc("GET /api/games/events", handleGameEvents)
+
+	srv := &http.Server{Addr: ":8080", Handler: logging.Middleware(logger)(mux)}
+	go func() {
+		logger.Info("server starting", "addr", ":8080")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("server stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
 
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	<-sigChan
+	logger.Info("shutting down")
+	cancel()
+	srv.Close()
 }
 
-func initKafka() {
-	brokers := os.Getenv("KAFKA_BROKERS")
-	if brokers == "" {
-		brokers = "kafka:9092"
-	}
+// publishEvent sends gameData to the event bus configured by EVENT_BUS,
+// stamping requestID on the outgoing context so a Publisher that supports
+// broker-native headers (e.g. Kafka) can carry it alongside payload,
+// letting the email consumer log the same ID and trace a star click
+// through to the email it sent.
+func publishEvent(gameData []byte, requestID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = eventbus.WithRequestID(ctx, requestID)
 
-	kafkaWriter = &kafka.Writer{
-		Addr:         kafka.TCP(strings.Split(brokers, ",")...),
-		Topic:        "game-events",
-		Balancer:     &kafka.LeastBytes{},
-		WriteTimeout: 10 * time.Second,
-		ReadTimeout:  10 * time.Second,
+	if err := publisher.Publish(ctx, "", gameData); err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
 	}
 
-	log.Printf("Kafka producer initialized, brokers: %s", brokers)
+	logger.Info("published event", "request_id", requestID)
+	return nil
 }
 
-func publishToKafka(gameData []byte) error {
-	message := kafka.Message{
-		Key:   []byte("game-star-event"),
-		Value: gameData,
-		Time:  time.Now(),
-	}
+// Outbox dispatcher tuning: how many rows to claim per poll, how often to
+// poll, and the exponential backoff applied to rows whose publish
+// fails.
+const (
+	outboxBatchSize    = 20
+	outboxPollInterval = 2 * time.Second
+	outboxBaseBackoff  = 2 * time.Second
+	outboxMaxBackoff   = 5 * time.Minute
+)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// outboxDispatcher polls game_events_outbox for unpublished rows and
+// publishes them to the event bus, giving at-least-once delivery without a
+// distributed transaction: the star update and the outbox insert commit
+// together, and the dispatcher is the only thing that talks to the broker.
+func outboxDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dispatchOutboxBatch()
+		}
+	}
+}
 
-	err := kafkaWriter.WriteMessages(ctx, message)
+// dispatchOutboxBatch claims a batch of unpublished rows with
+// FOR UPDATE SKIP LOCKED, so multiple backend replicas can run the
+// dispatcher concurrently without claiming the same row twice, then
+// publishes each one to the event bus and marks it published.
+func dispatchOutboxBatch() {
+	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to write message to Kafka: %v", err)
+		logger.Error("outbox: failed to begin transaction", "error", err)
+		return
 	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, payload, attempts, request_id FROM game_events_outbox
+		WHERE published_at IS NULL AND next_attempt_at <= now()
+		ORDER BY id
+		FOR UPDATE SKIP LOCKED
+		LIMIT $1`, outboxBatchSize)
+	if err != nil {
+		logger.Error("outbox: failed to claim rows", "error", err)
+		return
+	}
+
+	type claimedRow struct {
+		id        int64
+		payload   []byte
+		attempts  int
+		requestID sql.NullString
+	}
+	var claimed []claimedRow
+	for rows.Next() {
+		var c claimedRow
+		if err := rows.Scan(&c.id, &c.payload, &c.attempts, &c.requestID); err != nil {
+			rows.Close()
+			logger.Error("outbox: failed to scan claimed row", "error", err)
+			return
+		}
+		claimed = append(claimed, c)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		logger.Error("outbox: error iterating claimed rows", "error", err)
+		return
+	}
+	rows.Close()
+
+	for _, c := range claimed {
+		if err := publishEvent(c.payload, c.requestID.String); err != nil {
+			backoff := outboxBaseBackoff * time.Duration(int64(1)<<c.attempts)
+			if backoff > outboxMaxBackoff {
+				backoff = outboxMaxBackoff
+			}
+
+			if _, err := tx.Exec(
+				"UPDATE game_events_outbox SET attempts = attempts + 1, next_attempt_at = now() + ($2 * interval '1 second') WHERE id = $1",
+				c.id, int(backoff.Seconds()),
+			); err != nil {
+				logger.Error("outbox: failed to reschedule row", "id", c.id, "error", err)
+				return
+			}
+
+			logger.Warn("outbox: publish failed, retrying", "id", c.id, "attempt", c.attempts+1, "error", err, "backoff", backoff, "request_id", c.requestID.String)
+			continue
+		}
+
+		if _, err := tx.Exec("UPDATE game_events_outbox SET published_at = now() WHERE id = $1", c.id); err != nil {
+			logger.Error("outbox: failed to mark row published", "id", c.id, "error", err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Error("outbox: failed to commit dispatch batch", "error", err)
+	}
+}
 
-	log.Printf("Published event to Kafka topic: game-events")
+// enqueueOutboxEvent records payload in game_events_outbox as part of tx,
+// tagged with requestID so the dispatcher can later stamp the same ID on
+// the event bus message it publishes. It is committed or rolled back
+// atomically with the business-logic change that produced it.
+func enqueueOutboxEvent(tx *sql.Tx, payload []byte, requestID string) error {
+	if _, err := tx.Exec("INSERT INTO game_events_outbox (payload, request_id) VALUES ($1, $2)", payload, requestID); err != nil {
+		return fmt.Errorf("failed to enqueue outbox event: %w", err)
+	}
 	return nil
 }
 
@@ -123,7 +267,7 @@ func runMigrations(db *sql.DB) error {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
-	log.Println("Migrations completed successfully")
+	logger.Info("migrations completed successfully")
 	return nil
 }
 
@@ -169,11 +313,90 @@ func handleGames(w http.ResponseWriter, r *http.Request) {
 		}
 
 		newGame.Stars = 0
+		gameEventsHub.publish(newGame)
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(newGame)
 	}
 }
 
+// bulkRowError reports why a single row in a bulk ingest request was
+// skipped, identified by its position in the request body.
+type bulkRowError struct {
+	Index int    `json:"index"`
+	Title string `json:"title"`
+	Error string `json:"error"`
+}
+
+// handleBulkGames accepts a JSON array of games and loads them via the
+// COPY protocol instead of issuing one INSERT per row, for bulk imports of
+// thousands of games at once.
+func handleBulkGames(w http.ResponseWriter, r *http.Request) {
+	var newGames []Game
+	if err := json.NewDecoder(r.Body).Decode(&newGames); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inserted, rowErrors, err := bulkInsertGames(newGames)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"inserted": inserted,
+		"errors":   rowErrors,
+	})
+}
+
+// bulkInsertGames streams games into the games table via pq.CopyIn inside a
+// single transaction. Rows that fail validation are skipped and reported
+// back as rowErrors rather than aborting the whole batch; a COPY protocol
+// error, on the other hand, rolls back everything inserted so far.
+func bulkInsertGames(games []Game) (inserted int, rowErrors []bulkRowError, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("games", "title", "description", "stars"))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to prepare COPY: %w", err)
+	}
+
+	for i, game := range games {
+		if game.Title == "" {
+			rowErrors = append(rowErrors, bulkRowError{Index: i, Title: game.Title, Error: "title is required"})
+			continue
+		}
+
+		if _, err := stmt.Exec(game.Title, game.Description, game.Stars); err != nil {
+			stmt.Close()
+			return 0, nil, fmt.Errorf("COPY protocol error at row %d: %w", i, err)
+		}
+		inserted++
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return 0, nil, fmt.Errorf("failed to flush COPY: %w", err)
+	}
+
+	if err := stmt.Close(); err != nil {
+		return 0, nil, fmt.Errorf("failed to close COPY statement: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	logger.Info("bulk insert complete", "inserted", inserted, "rejected", len(rowErrors))
+	return inserted, rowErrors, nil
+}
+
 func handleGameActions(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/games/")
 	parts := strings.Split(path, "/")
@@ -189,8 +412,15 @@ func handleGameActions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "POST" {
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var game Game
-		err := db.QueryRow(
+		err = tx.QueryRow(
 			"UPDATE games SET stars = stars + 1 WHERE id = $1 RETURNING id, title, description, stars",
 			gameID,
 		).Scan(&game.ID, &game.Title, &game.Description, &game.Stars)
@@ -204,14 +434,32 @@ func handleGameActions(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		//do in a go-routine
-		body, err := json.Marshal(game)
-		if err := publishToKafka(body); err != nil {
-			log.Printf("Failed to publish to Kafka: %v", err)
-		} else {
-			log.Printf("Published event for game %d", game.ID)
+		body, err := json.Marshal(gameStarEvent{Game: game, EventID: idempotency.NewEventID()})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Record the event in the same transaction as the star update, so the
+		// dispatcher can never lose it or send a ghost event for a rolled
+		// back change. Tagging it with the request ID lets the eventual
+		// event bus message (and the email consumer that reads it) be traced
+		// back to this HTTP request.
+		requestID := logging.RequestIDFromContext(r.Context())
+		if err := enqueueOutboxEvent(tx, body, requestID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		logging.FromContext(r.Context(), logger).Info("recorded star event in outbox", "game_id", game.ID)
+
+		gameEventsHub.publish(game)
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(game)
 	}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseHeartbeatInterval controls how often idle clients receive a comment
+// line, so intermediate proxies and the browser's EventSource don't treat
+// the connection as dead.
+const sseHeartbeatInterval = 15 * time.Second
+
+// sseRingBufferSize bounds how many recent events are kept in memory for
+// Last-Event-ID replay; older events are simply lost to reconnecting
+// clients, which is acceptable for a live star count.
+const sseRingBufferSize = 100
+
+// sseEvent is one entry in the game-events stream, identified by a
+// monotonically increasing ID so clients can resume with Last-Event-ID.
+type sseEvent struct {
+	ID   int64
+	Data []byte
+}
+
+// sseHub fans out game events to every connected SSE client and keeps a
+// ring buffer of recent events so a reconnecting client can replay
+// whatever it missed.
+type sseHub struct {
+	mu      sync.Mutex
+	nextID  int64
+	buffer  []sseEvent
+	clients map[chan sseEvent]struct{}
+}
+
+func newSSEHub() *sseHub {
+	return &sseHub{
+		clients: make(map[chan sseEvent]struct{}),
+	}
+}
+
+// publish broadcasts game to every subscribed client and records it in the
+// ring buffer. Slow clients are never allowed to block the publisher: a
+// client whose buffered channel is full simply misses the event.
+func (h *sseHub) publish(game Game) {
+	data, err := json.Marshal(game)
+	if err != nil {
+		logger.Error("sse: failed to marshal game event", "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	h.nextID++
+	event := sseEvent{ID: h.nextID, Data: data}
+
+	h.buffer = append(h.buffer, event)
+	if len(h.buffer) > sseRingBufferSize {
+		h.buffer = h.buffer[len(h.buffer)-sseRingBufferSize:]
+	}
+
+	for client := range h.clients {
+		select {
+		case client <- event:
+		default:
+			logger.Warn("sse: client buffer full, dropping event", "event_id", event.ID)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// subscribe registers a new client and returns its event channel plus any
+// buffered events the client missed since lastEventID (0 means "no
+// replay"). The returned unsubscribe func must be called when the client
+// disconnects.
+func (h *sseHub) subscribe(lastEventID int64) (ch chan sseEvent, replay []sseEvent, unsubscribe func()) {
+	ch = make(chan sseEvent, 16)
+
+	h.mu.Lock()
+	if lastEventID > 0 {
+		for _, event := range h.buffer {
+			if event.ID > lastEventID {
+				replay = append(replay, event)
+			}
+		}
+	}
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe = func() {
+		h.mu.Lock()
+		delete(h.clients, ch)
+		h.mu.Unlock()
+	}
+	return ch, replay, unsubscribe
+}
+
+var gameEventsHub = newSSEHub()
+
+// handleGameEvents upgrades the request to text/event-stream and pushes a
+// JSON-encoded game every time one is created or starred, so the
+// SSR/CSR frontend can show a live star count without polling. Clients
+// that reconnect with a Last-Event-ID header are replayed whatever they
+// missed from the in-memory ring buffer.
+func handleGameEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastEventID int64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		fmt.Sscanf(id, "%d", &lastEventID)
+	}
+
+	ch, replay, unsubscribe := gameEventsHub.subscribe(lastEventID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range replay {
+		writeSSEEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			writeSSEEvent(w, event)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSEEvent(w http.ResponseWriter, event sseEvent) {
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, event.Data)
+}
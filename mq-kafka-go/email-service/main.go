@@ -2,17 +2,89 @@ package main
 
 import (
 	"context"
-	"log"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
 
+	_ "github.com/lib/pq"
 	"github.com/segmentio/kafka-go"
+
+	"email-service/idempotency"
 )
 
+// requestIDHeader is the Kafka message header the game service stamps
+// with the HTTP request ID that produced the event, so this service's log
+// lines can be correlated back to the request that triggered the email.
+const requestIDHeader = "request_id"
+
+// eventTTL is how long a processed EventID is remembered before the
+// idempotency sweeper reclaims it. It only needs to outlast the longest
+// plausible redelivery delay (a stalled rebalance, a backlog drain after
+// downtime), not the lifetime of the event itself.
+const eventTTL = 24 * time.Hour
+
+// starEvent is the subset of the published payload this service needs:
+// EventID to dedup on, and the fields it logs about the email it sends.
+type starEvent struct {
+	EventID string `json:"event_id"`
+	Title   string `json:"title"`
+}
+
+// newLogger builds a JSON logger whose minimum level is controlled by the
+// LOG_LEVEL environment variable (debug, info, warn, error; defaults to
+// info), matching the game service's logging package.
+func newLogger() *slog.Logger {
+	level := slog.LevelInfo
+	switch os.Getenv("LOG_LEVEL") {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+}
+
+func requestIDFromHeaders(headers []kafka.Header) string {
+	for _, h := range headers {
+		if h.Key == requestIDHeader {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
 func main() {
+	logger := newLogger()
+
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		dbURL = "postgres://postgres:postgres@db:5432/gamedb?sslmode=disable"
+	}
+
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		logger.Error("failed to connect to database", "error", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	for range 120 {
+		if err := db.Ping(); err == nil {
+			logger.Info("connected to database")
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	seenEvents := idempotency.New(db)
+
 	// Get Kafka broker addresses from environment
 	brokers := os.Getenv("KAFKA_BROKERS")
 	if brokers == "" {
@@ -34,20 +106,21 @@ func main() {
 	})
 	defer reader.Close()
 
-	log.Printf("📧 Email service started, consuming from topic: %s", topic)
-	log.Printf("📧 Connected to Kafka brokers: %s", brokers)
+	logger.Info("email service started", "topic", topic, "brokers", brokers)
 
 	// Handle graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	seenEvents.StartSweeper(ctx)
+
 	// Listen for interrupt signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigChan
-		log.Println("📧 Shutting down email service...")
+		logger.Info("shutting down email service")
 		cancel()
 	}()
 
@@ -55,12 +128,12 @@ func main() {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("📧 Email service stopped")
+			logger.Info("email service stopped")
 			return
 		default:
 			// Set read deadline to allow checking for shutdown
 			ctxWithTimeout, cancelTimeout := context.WithTimeout(ctx, 5*time.Second)
-			
+
 			message, err := reader.ReadMessage(ctxWithTimeout)
 			cancelTimeout()
 
@@ -69,17 +142,32 @@ func main() {
 					// Timeout is normal, continue loop
 					continue
 				}
-				log.Printf("No new message: %v", err)
+				logger.Warn("no new message", "error", err)
 				continue
 			}
 
-			log.Printf("📧 Processing email notification: %s", string(message.Value))
-			
+			requestID := requestIDFromHeaders(message.Headers)
+			msgLogger := logger.With("request_id", requestID)
+
+			var event starEvent
+			if err := json.Unmarshal(message.Value, &event); err != nil {
+				msgLogger.Warn("failed to parse event, processing without dedup", "error", err)
+			} else if event.EventID != "" {
+				firstTime, err := seenEvents.SeenOnce(ctx, event.EventID, eventTTL)
+				if err != nil {
+					msgLogger.Warn("idempotency check failed, processing anyway", "event_id", event.EventID, "error", err)
+				} else if !firstTime {
+					msgLogger.Info("skipping duplicate event", "event_id", event.EventID, "partition", message.Partition, "offset", message.Offset)
+					continue
+				}
+			}
+
+			msgLogger.Info("processing email notification", "payload", string(message.Value))
+
 			// Simulate email processing
 			time.Sleep(100 * time.Millisecond)
-			
-			log.Printf("✅ Email sent successfully (partition: %d, offset: %d)", 
-				message.Partition, message.Offset)
+
+			msgLogger.Info("email sent successfully", "partition", message.Partition, "offset", message.Offset)
 		}
 	}
-}
\ No newline at end of file
+}
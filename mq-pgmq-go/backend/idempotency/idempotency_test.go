@@ -0,0 +1,83 @@
+package idempotency
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewEventID_UniqueAndOrdered(t *testing.T) {
+	const n = 1000
+	ids := make([]string, n)
+
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i] = NewEventID()
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, n)
+	for _, id := range ids {
+		if len(id) != 36 || strings.Count(id, "-") != 4 {
+			t.Fatalf("malformed event id: %q", id)
+		}
+		if id[14] != '7' {
+			t.Fatalf("event id %q is not version 7", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate event id: %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+// memorySet stands in for the processed_events table: a mutex-guarded map
+// implementing the same "first insert wins" semantics as the
+// INSERT ... ON CONFLICT DO NOTHING RETURNING xmax = 0 query, so the
+// dedup algorithm's behavior under concurrent access can be benchmarked
+// without a live Postgres connection.
+type memorySet struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newMemorySet() *memorySet {
+	return &memorySet{seen: make(map[string]bool)}
+}
+
+func (m *memorySet) seenOnce(key string) (firstTime bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen[key] {
+		return false
+	}
+	m.seen[key] = true
+	return true
+}
+
+// BenchmarkSeenOnce_Contention measures dedup throughput when many
+// goroutines race to claim a small pool of keys, the shape of load a
+// rebalance storm produces: most keys are contended, and only one caller
+// per key should ever see firstTime == true.
+func BenchmarkSeenOnce_Contention(b *testing.B) {
+	const keyPoolSize = 64
+	keys := make([]string, keyPoolSize)
+	for i := range keys {
+		keys[i] = NewEventID()
+	}
+
+	set := newMemorySet()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			set.seenOnce(keys[i%keyPoolSize])
+			i++
+		}
+	})
+}
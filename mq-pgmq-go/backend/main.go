@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
+
+	"gameapi/idempotency"
 )
 
 type Game struct {
@@ -24,6 +27,15 @@ type Game struct {
 	Stars       int    `json:"stars"`
 }
 
+// gameStarEvent is the payload sent to the email queue for a star action.
+// It embeds Game so the wire shape stays a flat JSON object, with EventID
+// added so the consumer can recognize a redelivery of the same event and
+// skip reprocessing it.
+type gameStarEvent struct {
+	Game
+	EventID string `json:"event_id"`
+}
+
 var db *sql.DB
 
 func main() {
@@ -55,6 +67,8 @@ func main() {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
+	go relay(context.Background())
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /api/games", handleGames)
 	mux.HandleFunc("POST /api/games", handleGames)
@@ -147,8 +161,15 @@ func handleGameActions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "POST" {
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var game Game
-		err := db.QueryRow(
+		err = tx.QueryRow(
 			"UPDATE games SET stars = stars + 1 WHERE id = $1 RETURNING id, title, description, stars",
 			gameID,
 		).Scan(&game.ID, &game.Title, &game.Description, &game.Stars)
@@ -162,30 +183,147 @@ func handleGameActions(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		body, err := json.Marshal(game)
+		body, err := json.Marshal(gameStarEvent{Game: game, EventID: idempotency.NewEventID()})
 		if err != nil {
-			log.Printf("Failed to marshal game event: %v", err)
-		} else {
-			if err := publishToPGMQ(db, body); err != nil {
-				log.Printf("Failed to publish to PGMQ: %v", err)
-			} else {
-				log.Printf("Published event for game %d", game.ID)
-			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		if err := enqueueOutboxEvent(tx, "email_queue", body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Recorded star event for game %d in outbox", game.ID)
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(game)
 	}
 }
 
-func publishToPGMQ(db *sql.DB, gameData []byte) error {
-	// Send message to queue using SQL
-	var msgID int64
-	err := db.QueryRow("SELECT pgmq.send($1, $2)", "email_queue", string(gameData)).Scan(&msgID)
+// enqueueOutboxEvent records payload in outbox_events as part of tx, so the
+// star update and the publish intent commit atomically; the relay worker
+// delivers it to PGMQ afterwards.
+func enqueueOutboxEvent(tx *sql.Tx, topic string, payload []byte) error {
+	if _, err := tx.Exec("INSERT INTO outbox_events (topic, payload) VALUES ($1, $2)", topic, payload); err != nil {
+		return fmt.Errorf("failed to enqueue outbox event: %w", err)
+	}
+	return nil
+}
+
+// Relay tuning: how many rows to claim per poll, how often to poll, and the
+// exponential backoff bounds applied to rows whose publish attempt fails.
+const (
+	relayBatchSize    = 100
+	relayPollInterval = 2 * time.Second
+	relayBaseBackoff  = 2 * time.Second
+	relayMaxBackoff   = 5 * time.Minute
+)
+
+// relay polls outbox_events for rows still under their retry budget and
+// publishes them to PGMQ. The HTTP handler no longer touches the broker
+// directly, so a PGMQ outage delays delivery instead of dropping the event.
+func relay(ctx context.Context) {
+	ticker := time.NewTicker(relayPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			relayDispatchBatch()
+		}
+	}
+}
+
+type outboxClaim struct {
+	id       int64
+	topic    string
+	payload  []byte
+	attempts int
+}
+
+// relayDispatchBatch claims a batch of due outbox rows with SELECT ... FOR
+// UPDATE SKIP LOCKED (so multiple relay instances could run concurrently
+// without double-publishing), publishes each to PGMQ, and deletes rows that
+// succeed. Rows that fail are rescheduled with exponential backoff until
+// they exhaust max_attempts.
+func relayDispatchBatch() {
+	tx, err := db.Begin()
 	if err != nil {
+		log.Printf("relay: failed to begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, topic, payload, attempts FROM outbox_events
+		WHERE attempts < max_attempts AND next_attempt_at <= now()
+		ORDER BY id
+		FOR UPDATE SKIP LOCKED
+		LIMIT $1`, relayBatchSize)
+	if err != nil {
+		log.Printf("relay: failed to claim rows: %v", err)
+		return
+	}
+
+	var claims []outboxClaim
+	for rows.Next() {
+		var c outboxClaim
+		if err := rows.Scan(&c.id, &c.topic, &c.payload, &c.attempts); err != nil {
+			rows.Close()
+			log.Printf("relay: failed to scan claimed row: %v", err)
+			return
+		}
+		claims = append(claims, c)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("relay: error iterating claimed rows: %v", err)
+		return
+	}
+	rows.Close()
+
+	for _, c := range claims {
+		if err := publishToPGMQ(tx, c.topic, c.payload); err != nil {
+			backoff := relayBaseBackoff * time.Duration(int64(1)<<c.attempts)
+			if backoff > relayMaxBackoff {
+				backoff = relayMaxBackoff
+			}
+			if _, err := tx.Exec(
+				"UPDATE outbox_events SET attempts = attempts + 1, next_attempt_at = now() + ($2 * interval '1 second') WHERE id = $1",
+				c.id, backoff.Seconds(),
+			); err != nil {
+				log.Printf("relay: failed to reschedule row %d: %v", c.id, err)
+			}
+			log.Printf("relay: publish failed for row %d, retrying (attempt %d): %v", c.id, c.attempts+1, err)
+			continue
+		}
+
+		if _, err := tx.Exec("DELETE FROM outbox_events WHERE id = $1", c.id); err != nil {
+			log.Printf("relay: failed to delete published row %d: %v", c.id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("relay: failed to commit dispatch batch: %v", err)
+	}
+}
+
+// publishToPGMQ sends gameData to the PGMQ queue named topic as part of tx,
+// so the delete-on-success in relayDispatchBatch only commits once the
+// message has actually been enqueued.
+func publishToPGMQ(tx *sql.Tx, topic string, gameData []byte) error {
+	var msgID int64
+	if err := tx.QueryRow("SELECT pgmq.send($1, $2)", topic, string(gameData)).Scan(&msgID); err != nil {
 		return fmt.Errorf("failed to send message to PGMQ: %v", err)
 	}
 
-	log.Printf("Published event to PGMQ queue (message ID: %d)", msgID)
+	log.Printf("Published event to PGMQ queue %s (message ID: %d)", topic, msgID)
 	return nil
 }
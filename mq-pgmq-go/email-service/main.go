@@ -4,31 +4,59 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+
+	"email-service/idempotency"
 )
 
+// ConsumerConfig controls retry and dead-letter behavior for the queue consumer.
+type ConsumerConfig struct {
+	MaxAttempts       int64
+	VisibilityTimeout int
+	DeadLetterQueue   string
+	BaseBackoff       time.Duration
+}
+
+const maxBackoff = 5 * time.Minute
+
+var consumerCfg = ConsumerConfig{
+	MaxAttempts:       5,
+	VisibilityTimeout: 30,
+	DeadLetterQueue:   "email_queue_dlq",
+	BaseBackoff:       2 * time.Second,
+}
+
 type GameEvent struct {
 	ID          int    `json:"id"`
 	Title       string `json:"title"`
 	Description string `json:"description"`
 	Stars       int    `json:"stars"`
+	EventID     string `json:"event_id"`
 }
 
+// eventTTL is how long a processed EventID is remembered before the
+// idempotency sweeper reclaims it. It only needs to outlast the longest
+// plausible redelivery delay (a stuck visibility timeout, a backlog drain
+// after downtime), not the lifetime of the event itself.
+const eventTTL = 24 * time.Hour
+
 type Message struct {
-	MsgID       int64           `json:"msg_id"`
-	ReadCount   int64           `json:"read_count"`
-	EnqueuedAt  time.Time       `json:"enqueued_at"`
-	VT          time.Time       `json:"vt"`
-	Message     json.RawMessage `json:"message"`
+	MsgID      int64           `json:"msg_id"`
+	ReadCount  int64           `json:"read_count"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+	VT         time.Time       `json:"vt"`
+	Message    json.RawMessage `json:"message"`
 }
 
 var db *sql.DB
+var seenEvents *idempotency.Store
 
 func main() {
 	var err error
@@ -53,77 +81,50 @@ func main() {
 		}
 		time.Sleep(250 * time.Millisecond)
 	}
-	defer db.Close()
 
-	
+	seenEvents = idempotency.New(db)
+
 	queueName := "email_queue"
 	log.Printf("📧 Email service started, consuming from queue: %s", queueName)
 
+	listener := pq.NewListener(dbURL, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("❌ Listener event error: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen("email_queue_events"); err != nil {
+		log.Fatal("Failed to listen on email_queue_events:", err)
+	}
+
 	// Handle graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	seenEvents.StartSweeper(ctx)
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	// Start consuming messages
 	go func() {
+		// Drain whatever is already sitting in the queue at startup.
+		drainQueue(queueName)
+
+		fallback := time.NewTicker(30 * time.Second)
+		defer fallback.Stop()
+
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			default:
-				// Read message with 30-second visibility timeout using SQL
-				var message Message
-				err := db.QueryRow(`
-					SELECT msg_id, read_ct, enqueued_at, vt, message 
-					FROM pgmq.read($1, $2, $3)
-				`, queueName, 30, 1).Scan(
-					&message.MsgID, 
-					&message.ReadCount, 
-					&message.EnqueuedAt, 
-					&message.VT, 
-					&message.Message,
-				)
-
-				if err != nil {
-					if err == sql.ErrNoRows {
-						// No messages available, wait and try again
-						time.Sleep(1 * time.Second)
-						continue
-					}
-					log.Printf("❌ Error reading message: %v", err)
-					time.Sleep(5 * time.Second)
-					continue
-				}
-
-				log.Printf("📧 Processing email notification (ID: %d): %s", 
-					message.MsgID, string(message.Message))
-
-				// Parse the game event
-				var gameEvent GameEvent
-				if err := json.Unmarshal(message.Message, &gameEvent); err != nil {
-					log.Printf("❌ Failed to parse message: %v", err)
-					// Delete malformed message
-					db.Exec("SELECT pgmq.delete($1, $2)", queueName, message.MsgID)
-					continue
-				}
-
-				// Simulate email processing
-				time.Sleep(100 * time.Millisecond)
-
-				// Archive the message (keeps a record)
-				var archived bool
-				err = db.QueryRow("SELECT pgmq.archive($1::text, $2::bigint)", queueName, message.MsgID).Scan(&archived)
-				if err != nil {
-					log.Printf("❌ Failed to archive message %d: %v", message.MsgID, err)
-					continue
-				}
-
-				if archived {
-					log.Printf("✅ Email sent successfully for game: %s (archived message %d)",
-						gameEvent.Title, message.MsgID)
-				}
+			case <-listener.Notify:
+				drainQueue(queueName)
+			case <-fallback.C:
+				// Picks up messages enqueued while the listener was
+				// reconnecting after a dropped connection.
+				drainQueue(queueName)
 			}
 		}
 	}()
@@ -132,4 +133,129 @@ func main() {
 	<-sigChan
 	log.Println("📧 Shutting down email service...")
 	cancel()
-}
\ No newline at end of file
+}
+
+// drainQueue reads and processes messages from queueName until it is empty.
+func drainQueue(queueName string) {
+	for {
+		var message Message
+		err := db.QueryRow(`
+			SELECT msg_id, read_ct, enqueued_at, vt, message
+			FROM pgmq.read($1, $2, $3)
+		`, queueName, consumerCfg.VisibilityTimeout, 1).Scan(
+			&message.MsgID,
+			&message.ReadCount,
+			&message.EnqueuedAt,
+			&message.VT,
+			&message.Message,
+		)
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return
+			}
+			log.Printf("❌ Error reading message: %v", err)
+			return
+		}
+
+		if err := processMessage(queueName, message); err != nil {
+			handleProcessingFailure(queueName, message, err)
+		}
+	}
+}
+
+// processMessage handles a single message. Malformed payloads are a permanent
+// failure and are deleted immediately; any other error is treated as
+// transient and left for handleProcessingFailure to retry or dead-letter.
+func processMessage(queueName string, message Message) error {
+	log.Printf("📧 Processing email notification (ID: %d): %s",
+		message.MsgID, string(message.Message))
+
+	var gameEvent GameEvent
+	if err := json.Unmarshal(message.Message, &gameEvent); err != nil {
+		log.Printf("❌ Failed to parse message, discarding: %v", err)
+		db.Exec("SELECT pgmq.delete($1, $2)", queueName, message.MsgID)
+		return nil
+	}
+
+	if gameEvent.EventID != "" {
+		firstTime, err := seenEvents.SeenOnce(context.Background(), gameEvent.EventID, eventTTL)
+		if err != nil {
+			log.Printf("⚠️ Idempotency check failed, processing anyway: %v", err)
+		} else if !firstTime {
+			log.Printf("⏭️ Skipping duplicate event %s (message %d)", gameEvent.EventID, message.MsgID)
+			if _, err := db.Exec("SELECT pgmq.archive($1::text, $2::bigint)", queueName, message.MsgID); err != nil {
+				return fmt.Errorf("failed to archive duplicate message %d: %w", message.MsgID, err)
+			}
+			return nil
+		}
+	}
+
+	// Simulate email processing
+	time.Sleep(100 * time.Millisecond)
+
+	// Archive the message (keeps a record)
+	var archived bool
+	err := db.QueryRow("SELECT pgmq.archive($1::text, $2::bigint)", queueName, message.MsgID).Scan(&archived)
+	if err != nil {
+		return fmt.Errorf("failed to archive message %d: %w", message.MsgID, err)
+	}
+
+	if archived {
+		log.Printf("✅ Email sent successfully for game: %s (archived message %d)",
+			gameEvent.Title, message.MsgID)
+	}
+	return nil
+}
+
+// handleProcessingFailure either schedules a backed-off retry via pgmq.set_vt
+// or, once MaxAttempts is exceeded, moves the message to the dead-letter queue.
+func handleProcessingFailure(queueName string, message Message, procErr error) {
+	if message.ReadCount > consumerCfg.MaxAttempts {
+		sendToDeadLetterQueue(queueName, message, procErr)
+		return
+	}
+
+	backoff := consumerCfg.BaseBackoff * time.Duration(int64(1)<<(message.ReadCount-1))
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	if _, err := db.Exec("SELECT pgmq.set_vt($1, $2, $3)", queueName, message.MsgID, int(backoff.Seconds())); err != nil {
+		log.Printf("❌ Failed to reschedule message %d: %v", message.MsgID, err)
+		return
+	}
+
+	log.Printf("⏳ Message %d failed (attempt %d): %v — retrying in %s",
+		message.MsgID, message.ReadCount, procErr, backoff)
+}
+
+func sendToDeadLetterQueue(queueName string, message Message, procErr error) {
+	dlqPayload := map[string]any{
+		"original_msg_id": message.MsgID,
+		"payload":         message.Message,
+		"read_ct":         message.ReadCount,
+		"last_error":      procErr.Error(),
+		"failed_at":       time.Now(),
+	}
+
+	body, err := json.Marshal(dlqPayload)
+	if err != nil {
+		log.Printf("❌ Failed to marshal DLQ payload for message %d: %v", message.MsgID, err)
+		return
+	}
+
+	var dlqMsgID int64
+	if err := db.QueryRow("SELECT pgmq.send($1, $2::jsonb)", consumerCfg.DeadLetterQueue, string(body)).Scan(&dlqMsgID); err != nil {
+		log.Printf("❌ Failed to send message %d to DLQ: %v", message.MsgID, err)
+		return
+	}
+
+	if _, err := db.Exec("SELECT pgmq.delete($1, $2)", queueName, message.MsgID); err != nil {
+		log.Printf("❌ Failed to delete message %d after dead-lettering: %v", message.MsgID, err)
+		return
+	}
+
+	log.Printf("💀 Message %d exceeded %d attempts, moved to %s as message %d",
+		message.MsgID, consumerCfg.MaxAttempts, consumerCfg.DeadLetterQueue, dlqMsgID)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type Game struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Stars       int    `json:"stars"`
+}
+
+const (
+	listenChannel     = "email_channel"
+	listenerMinRetry  = 20 * time.Millisecond
+	listenerMaxRetry  = time.Hour
+	heartbeatInterval = 90 * time.Second
+)
+
+func main() {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		dbURL = "postgres://postgres:postgres@db:5432/gamedb?sslmode=disable"
+	}
+
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	defer db.Close()
+
+	listener := pq.NewListener(dbURL, listenerMinRetry, listenerMaxRetry, reportListenerProblem)
+	defer listener.Close()
+
+	if err := listener.Listen(listenChannel); err != nil {
+		log.Fatal("Failed to listen on channel:", err)
+	}
+
+	log.Printf("📧 Email service started, listening on channel: %s", listenChannel)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-sigChan:
+			log.Println("📧 Shutting down email service...")
+			return
+
+		case <-heartbeat.C:
+			// Ping lets pq.Listener detect a dead connection (and start
+			// reconnecting) instead of silently sitting on a socket the
+			// network already dropped.
+			if err := listener.Ping(); err != nil {
+				log.Printf("listener ping failed: %v", err)
+			}
+
+		case n := <-listener.Notify:
+			if n == nil {
+				// A nil notification means the connection was lost and
+				// pq.Listener is reconnecting; the channel subscription
+				// survives the reconnect, so there's nothing to redo here.
+				continue
+			}
+			handleNotification(db, n.Extra)
+		}
+	}
+}
+
+func reportListenerProblem(ev pq.ListenerEventType, err error) {
+	if err != nil {
+		log.Printf("listener event %v: %v", ev, err)
+	}
+}
+
+// handleNotification decodes the NOTIFY payload sent by the backend. A
+// payload that parses as a Game is the event inline; anything else is
+// expected to be a pending_notifications row id, used when the event was
+// too large for Postgres' 8000-byte NOTIFY limit.
+func handleNotification(db *sql.DB, payload string) {
+	var game Game
+	if err := json.Unmarshal([]byte(payload), &game); err == nil {
+		processGameEvent(game)
+		return
+	}
+
+	rowID, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		log.Printf("Unrecognized notification payload: %s", payload)
+		return
+	}
+
+	var body []byte
+	err = db.QueryRow("DELETE FROM pending_notifications WHERE id = $1 RETURNING payload", rowID).Scan(&body)
+	if err != nil {
+		log.Printf("Failed to fetch pending notification %d: %v", rowID, err)
+		return
+	}
+
+	if err := json.Unmarshal(body, &game); err != nil {
+		log.Printf("Failed to decode pending notification %d: %v", rowID, err)
+		return
+	}
+	processGameEvent(game)
+}
+
+func processGameEvent(game Game) {
+	log.Printf("📧 Processing email notification: game %d now has %d stars", game.ID, game.Stars)
+
+	// Simulate email processing
+	time.Sleep(100 * time.Millisecond)
+
+	log.Printf("✅ Email sent successfully for game %d", game.ID)
+}
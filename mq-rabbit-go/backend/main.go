@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -16,6 +17,8 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
 	"github.com/streadway/amqp"
+
+	"gameapi/idempotency"
 )
 
 type Game struct {
@@ -25,6 +28,15 @@ type Game struct {
 	Stars       int    `json:"stars"`
 }
 
+// gameStarEvent is the payload published to the event bus for a star
+// action. It embeds Game so the wire shape stays a flat JSON object, with
+// EventID added so downstream consumers can recognize a redelivery of the
+// same event and skip reprocessing it.
+type gameStarEvent struct {
+	Game
+	EventID string `json:"event_id"`
+}
+
 var db *sql.DB
 var rabbitConn *amqp.Connection
 var rabbitCh *amqp.Channel
@@ -83,19 +95,61 @@ func main() {
 		log.Fatal("Failed to open RabbitMQ channel:", err)
 	}
 
-	// Declare queue
+	// Declare a fanout DLX.game_events exchange and DLX.email_queue bound
+	// to it, so messages the email consumer gives up on after exhausting
+	// its retries land somewhere inspectable instead of vanishing.
+	err = rabbitCh.ExchangeDeclare(
+		"DLX.game_events",
+		"fanout",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Fatal("Failed to declare dead-letter exchange:", err)
+	}
+
+	dlxQueue, err := rabbitCh.QueueDeclare(
+		"DLX.email_queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Fatal("Failed to declare dead-letter queue:", err)
+	}
+
+	err = rabbitCh.QueueBind(
+		dlxQueue.Name,
+		"",
+		"DLX.game_events",
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Fatal("Failed to bind dead-letter queue:", err)
+	}
+
+	// Declare queue. Messages the consumer nacks after exhausting its
+	// retries are routed to DLX.game_events via this argument.
 	_, err = rabbitCh.QueueDeclare(
 		"email_queue",
 		true,
 		false,
 		false,
 		false,
-		nil,
+		amqp.Table{"x-dead-letter-exchange": "DLX.game_events"},
 	)
 	if err != nil {
 		log.Fatal("Failed to declare queue:", err)
 	}
 
+	go relay(context.Background())
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /api/games", handleGames)
 	mux.HandleFunc("POST /api/games", handleGames)
@@ -188,8 +242,15 @@ func handleGameActions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "POST" {
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
 		var game Game
-		err := db.QueryRow(
+		err = tx.QueryRow(
 			"UPDATE games SET stars = stars + 1 WHERE id = $1 RETURNING id, title, description, stars",
 			gameID,
 		).Scan(&game.ID, &game.Title, &game.Description, &game.Stars)
@@ -203,33 +264,160 @@ func handleGameActions(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Publish event to RabbitMQ
-		if rabbitCh != nil {
-			body, err := json.Marshal(game)
-			if err != nil {
-				log.Printf("Failed to marshal game event: %v", err)
-			} else {
-				err = rabbitCh.Publish(
-					//"",            // exchange
-					//"email_queue", // routing key
-					"game_events",  // exchange (instead of "")
-					"",             // routing key (empty for fanout)
-					false,         // mandatory
-					false,         // immediate,
-					amqp.Publishing{
-						ContentType: "application/json",
-						Body:        body,
-						DeliveryMode: 2, //2 is persistent mode
-					})
-				if err != nil {
-					log.Printf("Failed to publish message: %v", err)
-				} else {
-					log.Printf("Published event for game %d", game.ID)
-				}
-			}
+		body, err := json.Marshal(gameStarEvent{Game: game, EventID: idempotency.NewEventID()})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := enqueueOutboxEvent(tx, "email_queue", body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		log.Printf("Recorded star event for game %d in outbox", game.ID)
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(game)
 	}
 }
+
+// enqueueOutboxEvent records payload in outbox_events as part of tx, so the
+// star update and the publish intent commit atomically; the relay worker
+// delivers it to RabbitMQ afterwards.
+func enqueueOutboxEvent(tx *sql.Tx, topic string, payload []byte) error {
+	if _, err := tx.Exec("INSERT INTO outbox_events (topic, payload) VALUES ($1, $2)", topic, payload); err != nil {
+		return fmt.Errorf("failed to enqueue outbox event: %w", err)
+	}
+	return nil
+}
+
+// Relay tuning: how many rows to claim per poll, how often to poll, and the
+// exponential backoff bounds applied to rows whose publish attempt fails.
+const (
+	relayBatchSize    = 100
+	relayPollInterval = 2 * time.Second
+	relayBaseBackoff  = 2 * time.Second
+	relayMaxBackoff   = 5 * time.Minute
+)
+
+// relay polls outbox_events for rows still under their retry budget and
+// publishes them to RabbitMQ. The HTTP handler no longer touches the
+// broker directly, so a RabbitMQ outage delays delivery instead of
+// dropping the event.
+func relay(ctx context.Context) {
+	ticker := time.NewTicker(relayPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			relayDispatchBatch()
+		}
+	}
+}
+
+type outboxClaim struct {
+	id       int64
+	topic    string
+	payload  []byte
+	attempts int
+}
+
+// relayDispatchBatch claims a batch of due outbox rows with SELECT ... FOR
+// UPDATE SKIP LOCKED (so multiple relay instances could run concurrently
+// without double-publishing), publishes each to RabbitMQ, and deletes rows
+// that succeed. Rows that fail are rescheduled with exponential backoff
+// until they exhaust max_attempts.
+func relayDispatchBatch() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("relay: failed to begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, topic, payload, attempts FROM outbox_events
+		WHERE attempts < max_attempts AND next_attempt_at <= now()
+		ORDER BY id
+		FOR UPDATE SKIP LOCKED
+		LIMIT $1`, relayBatchSize)
+	if err != nil {
+		log.Printf("relay: failed to claim rows: %v", err)
+		return
+	}
+
+	var claims []outboxClaim
+	for rows.Next() {
+		var c outboxClaim
+		if err := rows.Scan(&c.id, &c.topic, &c.payload, &c.attempts); err != nil {
+			rows.Close()
+			log.Printf("relay: failed to scan claimed row: %v", err)
+			return
+		}
+		claims = append(claims, c)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("relay: error iterating claimed rows: %v", err)
+		return
+	}
+	rows.Close()
+
+	for _, c := range claims {
+		if err := publishToRabbitMQ(c.topic, c.payload); err != nil {
+			backoff := relayBaseBackoff * time.Duration(int64(1)<<c.attempts)
+			if backoff > relayMaxBackoff {
+				backoff = relayMaxBackoff
+			}
+			if _, err := tx.Exec(
+				"UPDATE outbox_events SET attempts = attempts + 1, next_attempt_at = now() + ($2 * interval '1 second') WHERE id = $1",
+				c.id, backoff.Seconds(),
+			); err != nil {
+				log.Printf("relay: failed to reschedule row %d: %v", c.id, err)
+			}
+			log.Printf("relay: publish failed for row %d, retrying (attempt %d): %v", c.id, c.attempts+1, err)
+			continue
+		}
+
+		if _, err := tx.Exec("DELETE FROM outbox_events WHERE id = $1", c.id); err != nil {
+			log.Printf("relay: failed to delete published row %d: %v", c.id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("relay: failed to commit dispatch batch: %v", err)
+	}
+}
+
+// publishToRabbitMQ sends gameData to the game_events exchange with topic as
+// the routing key.
+func publishToRabbitMQ(topic string, gameData []byte) error {
+	if rabbitCh == nil {
+		return fmt.Errorf("no RabbitMQ channel available")
+	}
+
+	err := rabbitCh.Publish(
+		"game_events", // exchange
+		topic,         // routing key
+		false,         // mandatory
+		false,         // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         gameData,
+			DeliveryMode: 2, // persistent
+		})
+	if err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	log.Printf("Published event to RabbitMQ exchange game_events (routing key %s)", topic)
+	return nil
+}
@@ -0,0 +1,100 @@
+// Package idempotency guards consumers against reprocessing the same
+// broker message twice. At-least-once delivery means any event can be
+// redelivered after a Nack, a rebalance, or a consumer restart; Store
+// records every EventID it has seen in a processed_events table so a
+// redelivery is recognized and skipped before the consumer repeats its
+// side effects (e.g. sending a duplicate email).
+package idempotency
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Store tracks which event IDs have already been processed, backed by a
+// Postgres handle. The same table and query work against any database
+// reachable through database/sql, so a Redis-backed Store could satisfy
+// the same shape if a future variant needs it.
+type Store struct {
+	db *sql.DB
+}
+
+// New wraps db for use as an idempotency store. db is expected to have a
+// processed_events table (see migrations/0003_processed_events.up.sql).
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// SeenOnce records key as processed, expiring ttl from now, and reports
+// whether this call is the first to see it. It's built on
+// INSERT ... ON CONFLICT DO NOTHING RETURNING xmax = 0: xmax is left at
+// its zero value only on the row this statement actually inserted, so a
+// key that already has a row (including one raced in by a concurrent
+// consumer) reports firstTime == false without a separate SELECT.
+func (s *Store) SeenOnce(ctx context.Context, key string, ttl time.Duration) (firstTime bool, err error) {
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO processed_events (event_id, processed_at, expires_at)
+		VALUES ($1, now(), now() + $2 * interval '1 second')
+		ON CONFLICT (event_id) DO NOTHING
+		RETURNING (xmax = 0)`,
+		key, ttl.Seconds(),
+	).Scan(&firstTime)
+
+	if err == sql.ErrNoRows {
+		// DO NOTHING skipped the insert because a row was already there,
+		// so there was nothing to RETURN: this key has been seen before.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record event %s: %w", key, err)
+	}
+	return firstTime, nil
+}
+
+// sweepInterval is how often StartSweeper deletes expired rows.
+const sweepInterval = 5 * time.Minute
+
+// StartSweeper launches a goroutine that periodically deletes expired rows
+// from processed_events so the table doesn't grow without bound, running
+// until ctx is canceled.
+func (s *Store) StartSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.db.ExecContext(ctx, "DELETE FROM processed_events WHERE expires_at < now()")
+			}
+		}
+	}()
+}
+
+// NewEventID returns a new UUIDv7 string: a timestamp-prefixed UUID whose
+// lexical order matches creation order, so event IDs double as a rough
+// time-ordering key alongside their use as the idempotency dedup key.
+func NewEventID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("idempotency: failed to read random bytes: %v", err))
+	}
+
+	ms := uint64(time.Now().UnixMilli())
+	copy(b[0:6], []byte{
+		byte(ms >> 40), byte(ms >> 32), byte(ms >> 24),
+		byte(ms >> 16), byte(ms >> 8), byte(ms),
+	})
+
+	b[6] = (b[6] & 0x0f) | 0x70 // version 7
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+	hexStr := hex.EncodeToString(b[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hexStr[0:8], hexStr[8:12], hexStr[12:16], hexStr[16:20], hexStr[20:32])
+}
@@ -16,6 +16,8 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
 	"github.com/pebbe/zmq4"
+
+	"gameapi/idempotency"
 )
 
 type Game struct {
@@ -25,6 +27,15 @@ type Game struct {
 	Stars       int    `json:"stars"`
 }
 
+// gameStarEvent is the payload published over ZeroMQ for a star action. It
+// embeds Game so the wire shape stays a flat JSON object, with EventID
+// added so the consumer can recognize a redelivery of the same event and
+// skip reprocessing it.
+type gameStarEvent struct {
+	Game
+	EventID string `json:"event_id"`
+}
+
 var db *sql.DB
 var zmqContext *zmq4.Context
 var zmqPublisher *zmq4.Socket
@@ -187,7 +198,7 @@ func handleGameActions(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		body, err := json.Marshal(game)
+		body, err := json.Marshal(gameStarEvent{Game: game, EventID: idempotency.NewEventID()})
 		_, err = zmqPublisher.Send(string(body), 0)
 		if err != nil {
 			log.Printf("Failed to publish ZMQ message: %v", err)
@@ -1,14 +1,51 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"log"
 	"os"
 	"time"
 
+	_ "github.com/lib/pq"
 	zmq "github.com/pebbe/zmq4"
+
+	"email-service/idempotency"
 )
 
+// eventTTL is how long a processed EventID is remembered before the
+// idempotency sweeper reclaims it. It only needs to outlast the longest
+// plausible redelivery delay, not the lifetime of the event itself.
+const eventTTL = 24 * time.Hour
+
+// starEvent is the subset of the published payload this service needs:
+// EventID to dedup on.
+type starEvent struct {
+	EventID string `json:"event_id"`
+}
+
 func main() {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		dbURL = "postgres://postgres:postgres@db:5432/gamedb?sslmode=disable"
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 120; i++ {
+		if err := db.Ping(); err == nil {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	seenEvents := idempotency.New(db)
+	idemCtx, cancelIdem := context.WithCancel(context.Background())
+	defer cancelIdem()
+	seenEvents.StartSweeper(idemCtx)
+
 	// Get publisher address from environment or use default
 	publisherAddr := os.Getenv("PUBLISHER_ADDR")
 	if publisherAddr == "" {
@@ -16,13 +53,13 @@ func main() {
 	}
 
 	// Create ZeroMQ context and subscriber socket
-	context, err := zmq.NewContext()
+	zmqCtx, err := zmq.NewContext()
 	if err != nil {
 		log.Fatalf("Failed to create ZMQ context: %v", err)
 	}
-	defer context.Term()
+	defer zmqCtx.Term()
 
-	subscriber, err := context.NewSocket(zmq.PULL) //SUB
+	subscriber, err := zmqCtx.NewSocket(zmq.PULL) //SUB
 	if err != nil {
 		log.Fatalf("Failed to create subscriber socket: %v", err)
 	}
@@ -60,10 +97,23 @@ func main() {
 		}
 
 		log.Printf("📧 Processing email: %s", message)
-		
+
+		var event starEvent
+		if err := json.Unmarshal([]byte(message), &event); err != nil {
+			log.Printf("⚠️ Failed to parse event, processing without dedup: %v", err)
+		} else if event.EventID != "" {
+			firstTime, err := seenEvents.SeenOnce(idemCtx, event.EventID, eventTTL)
+			if err != nil {
+				log.Printf("⚠️ Idempotency check failed, processing anyway: %v", err)
+			} else if !firstTime {
+				log.Printf("⏭️ Skipping duplicate event %s", event.EventID)
+				continue
+			}
+		}
+
 		// Simulate email processing
 		time.Sleep(100 * time.Millisecond)
-		
+
 		log.Printf("✅ Email sent successfully")
 	}
-}
\ No newline at end of file
+}
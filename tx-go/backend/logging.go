@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// newLogger builds a JSON logger whose minimum level is controlled by the
+// LOG_LEVEL environment variable (debug, info, warn, error; defaults to
+// info).
+func newLogger() *slog.Logger {
+	level := slog.LevelInfo
+	switch os.Getenv("LOG_LEVEL") {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+}
+
+// requestIDMiddleware reuses an inbound X-Request-ID header if present,
+// otherwise mints a new one, stashes it on the request context, and echoes
+// it back as a response header so it can be correlated across log lines.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+
+		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// loggerFromContext returns logger with the request's request_id attached,
+// if any, so handlers don't need to thread the ID through separately.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey).(string); ok && id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
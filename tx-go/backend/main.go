@@ -3,15 +3,17 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Game struct {
@@ -28,53 +30,75 @@ type GameStatistics struct {
 	LastUpdated time.Time `json:"last_updated"`
 }
 
-var db *sql.DB
+// GameEvent is the payload enqueued to email_queue whenever a game's star
+// count changes, so downstream consumers can notify without polling games.
+type GameEvent struct {
+	GameID    int       `json:"game_id"`
+	Stars     int       `json:"stars"`
+	EventType string    `json:"event_type"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// SQL used by the transaction demo functions, shared with their tests so
+// both sides stay in sync as queries change.
+const (
+	sqlLockGameForUpdate = "SELECT stars FROM games WHERE id = $1 FOR UPDATE"
+	sqlSelectGameStars   = "SELECT stars FROM games WHERE id = $1"
+	sqlDeductStars       = "UPDATE games SET stars = stars - $1 WHERE id = $2"
+	sqlAddStars          = "UPDATE games SET stars = stars + $1 WHERE id = $2"
+	sqlDeductOneStar     = "UPDATE games SET stars = stars - 1 WHERE id = $1"
+	sqlAddOneStar        = "UPDATE games SET stars = stars + 1 WHERE id = $1"
+	sqlEnqueueMessage    = "SELECT pgmq.send($1, $2::jsonb)"
+)
+
+var db Store
+var logger *slog.Logger
 
 func main() {
 	var err error
+	var driver string
+	logger = newLogger()
 
-	// Get database URL from environment
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		dbURL = "postgres://postgres:postgres@db:5432/gamedb?sslmode=disable"
-	}
-
-	db, err = sql.Open("postgres", dbURL)
+	db, driver, err = openStore()
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		logger.Error("failed to connect to database", "error", err)
+		os.Exit(1)
 	}
 	defer db.Close()
 
 	// Wait for database to be ready
 	for range 120 {
 		if err := db.Ping(); err == nil {
-			log.Println("Connected to database")
+			logger.Info("connected to database")
 			break
 		}
 		time.Sleep(250 * time.Millisecond)
 	}
 
 	if err := db.Ping(); err != nil {
-		log.Fatal("Failed to connect to database after retries:", err)
+		logger.Error("failed to connect to database after retries", "error", err)
+		os.Exit(1)
 	}
 
 	// Initialize database schema
-	if err := initDB(); err != nil {
-		log.Fatal("Failed to initialize database:", err)
+	if err := runMigrations(db, driver); err != nil {
+		logger.Error("failed to initialize database", "error", err)
+		os.Exit(1)
 	}
 
 	// Load sample data
 	if err := loadSampleData(); err != nil {
-		log.Fatal("Failed to load sample data:", err)
+		logger.Error("failed to load sample data", "error", err)
+		os.Exit(1)
 	}
 
 	mux := http.NewServeMux()
-	
+
 	// Original endpoints
 	mux.HandleFunc("GET /api/games", handleGames)
 	mux.HandleFunc("POST /api/games", handleGames)
 	mux.HandleFunc("POST /api/games/{id}/star", handleGameActions)
-	
+
 	// Transaction demo endpoints
 	mux.HandleFunc("POST /api/demo/with-transaction/{id}", handleWithTransaction)
 	mux.HandleFunc("POST /api/demo/without-transaction/{id}", handleWithoutTransaction)
@@ -82,38 +106,32 @@ func main() {
 	mux.HandleFunc("POST /api/demo/transfer-no-tx", handleTransferStarsNoTx)
 	mux.HandleFunc("GET /api/demo/game/{id}", handleGetGameDetails)
 
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	logger.Info("server starting", "addr", ":8080")
+	if err := http.ListenAndServe(":8080", requestIDMiddleware(mux)); err != nil {
+		logger.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
 }
 
-func initDB() error {
-	// Create games table
-	gamesTable := `
-	CREATE TABLE IF NOT EXISTS games (
-		id SERIAL PRIMARY KEY,
-		title VARCHAR(255) NOT NULL,
-		description TEXT NOT NULL,
-		stars INTEGER DEFAULT 0
-	);`
-
-	// Create game_statistics table
-	statsTable := `
-	CREATE TABLE IF NOT EXISTS game_statistics (
-		id SERIAL PRIMARY KEY,
-		game_id INTEGER UNIQUE NOT NULL REFERENCES games(id) ON DELETE CASCADE,
-		total_stars INTEGER DEFAULT 0,
-		last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	if _, err := db.Exec(gamesTable); err != nil {
-		return err
+// enqueueInTx sends payload to queue as part of the given transaction, so the
+// enqueue is committed or rolled back atomically with the rest of tx's work.
+// It is a no-op on sqlite, which doesn't have the pgmq extension that backs
+// this demo's email queue.
+func enqueueInTx(tx Tx, queue string, payload any) error {
+	if tx.Driver() != "postgres" {
+		return nil
 	}
 
-	if _, err := db.Exec(statsTable); err != nil {
-		return err
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload for queue %s: %w", queue, err)
+	}
+
+	var msgID int64
+	if err := tx.QueryRow(sqlEnqueueMessage, queue, string(body)).Scan(&msgID); err != nil {
+		return fmt.Errorf("failed to enqueue message to %s: %w", queue, err)
 	}
 
-	log.Println("Database schema initialized")
 	return nil
 }
 
@@ -125,7 +143,7 @@ func loadSampleData() error {
 	}
 
 	if count > 0 {
-		log.Println("Sample data already exists")
+		logger.Info("sample data already exists")
 		return nil
 	}
 
@@ -150,7 +168,7 @@ func loadSampleData() error {
 		}
 	}
 
-	log.Println("Sample games loaded")
+	logger.Info("sample games loaded")
 	return nil
 }
 
@@ -448,7 +466,7 @@ func handleTransferStarsNoTx(w http.ResponseWriter, r *http.Request) {
 func addStarWithTransaction(gameID int) error {
 	const fromGameID = 1 // Game 1 receives the star
 	toGameID := gameID   // Target game loses the star
-	
+
 	// Begin transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -460,42 +478,66 @@ func addStarWithTransaction(gameID int) error {
 
 	// Operation 1: Deduct star from TO game
 	var toStars int
-	err = tx.QueryRow("SELECT stars FROM games WHERE id = $1", toGameID).Scan(&toStars)
+	err = tx.QueryRow(sqlSelectGameStars, toGameID).Scan(&toStars)
 	if err != nil {
-		log.Println("Operation 1 failed (select to):", err)
+		logger.Error("operation 1 failed (select to)", "error", err)
 		return err
 	}
-	
+
 	if toStars < 1 {
 		return fmt.Errorf("target game has no stars to transfer")
 	}
-	
-	_, err = tx.Exec("UPDATE games SET stars = stars - 1 WHERE id = $1", toGameID)
+
+	_, err = tx.Exec(sqlDeductOneStar, toGameID)
 	if err != nil {
-		log.Println("Operation 1 failed (deduct from to):", err)
+		logger.Error("operation 1 failed (deduct from to)", "error", err)
 		return err
 	}
-	log.Printf("Operation 1: Deducted 1 star from game %d\n", toGameID)
+	logger.Info("operation 1: deducted 1 star", "game_id", toGameID)
 
 	// Simulate failure here
 	// Uncomment to test rollback:
 	// return fmt.Errorf("Simulated failure! Network error!")
 
 	// Operation 2: Add star to FROM game
-	_, err = tx.Exec("UPDATE games SET stars = stars + 1 WHERE id = $1", fromGameID)
+	_, err = tx.Exec(sqlAddOneStar, fromGameID)
 	if err != nil {
-		log.Println("Operation 2 failed (add to from):", err)
+		logger.Error("operation 2 failed (add to from)", "error", err)
 		return err // Rollback happens automatically
 	}
-	log.Printf("Operation 2: Added 1 star to game %d\n", fromGameID)
+	logger.Info("operation 2: added 1 star", "game_id", fromGameID)
+
+	var fromStars int
+	if err := tx.QueryRow(sqlSelectGameStars, fromGameID).Scan(&fromStars); err != nil {
+		return err
+	}
+
+	// Emit notification events in the same transaction as the star change,
+	// so a crash or error after this point rolls the enqueue back too.
+	if err := enqueueInTx(tx, "email_queue", GameEvent{
+		GameID:    toGameID,
+		Stars:     toStars - 1,
+		EventType: "star_deducted",
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if err := enqueueInTx(tx, "email_queue", GameEvent{
+		GameID:    fromGameID,
+		Stars:     fromStars,
+		EventType: "star_added",
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
 
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
-		log.Println("Commit failed:", err)
+		logger.Error("commit failed", "error", err)
 		return err
 	}
 
-	log.Println("Transaction committed successfully")
+	logger.Info("transaction committed successfully")
 	return nil
 }
 
@@ -503,93 +545,264 @@ func addStarWithTransaction(gameID int) error {
 // Just adds to game 1 (FROM), no deduction
 func addStarWithoutTransaction(gameID int) error {
 	const fromGameID = 1 // Game 1 receives the star
-	
+
 	// Operation 1: Add star to FROM game (NO TRANSACTION)
 	_, err := db.Exec("UPDATE games SET stars = stars + 1 WHERE id = $1", fromGameID)
 	if err != nil {
-		log.Println("Operation 1 failed:", err)
+		logger.Error("operation 1 failed", "error", err)
 		return err
 	}
-	log.Printf("Operation 1: Added 1 star to game %d (SAVED TO DB)\n", fromGameID)
+	logger.Info("operation 1: added 1 star (saved to db)", "game_id", fromGameID)
 
 	return nil
 }
 
-// Transfer stars with transaction
+// maxTransferAttempts bounds how many times transferStarsWithTransaction
+// retries after a serialization failure or deadlock before giving up and
+// returning the error to the caller.
+const maxTransferAttempts = 3
+
+// isSerializationFailure reports whether err is a PostgreSQL serialization
+// failure (40001, raised under SERIALIZABLE isolation when two
+// transactions can't both be honored) or a deadlock (40P01) — both are
+// safe to retry since the transaction that hit them made no changes.
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
+
+// Transfer stars with transaction. Runs at SERIALIZABLE isolation and
+// retries on serialization failures/deadlocks with jittered backoff, since
+// under concurrent transfers over the same pair of games Postgres can
+// abort one side rather than let it commit against a stale read.
 func transferStarsWithTransaction(fromID, toID, stars int) error {
-	tx, err := db.Begin()
+	var err error
+	for attempt := 1; attempt <= maxTransferAttempts; attempt++ {
+		err = attemptTransferStarsWithTransaction(fromID, toID, stars)
+		if err == nil || !isSerializationFailure(err) {
+			return err
+		}
+
+		backoff := time.Duration(attempt*10+rand.Intn(20)) * time.Millisecond
+		logger.Warn("transfer attempt hit conflict, retrying", "attempt", attempt, "max_attempts", maxTransferAttempts, "error", err, "backoff", backoff)
+		time.Sleep(backoff)
+	}
+	return err
+}
+
+func attemptTransferStarsWithTransaction(fromID, toID, stars int) error {
+	tx, err := db.BeginTx(sql.LevelSerializable)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	// Operation 1: Check and deduct stars from source game
-	var fromStarsBefore int
-	err = tx.QueryRow("SELECT stars FROM games WHERE id = $1", fromID).Scan(&fromStarsBefore)
+	// Lock both rows FOR UPDATE before reading them, in ascending id order
+	// (regardless of from/to), so two concurrent transfers over the same
+	// pair of games can't both pass the "enough stars" check against the
+	// same snapshot, and so they always acquire locks in the same order
+	// to avoid deadlocking each other.
+	lockedStars, err := lockGamesForUpdate(tx, fromID, toID)
 	if err != nil {
 		return err
 	}
+	fromStarsBefore := lockedStars[fromID]
+	toStarsBefore := lockedStars[toID]
 
 	if fromStarsBefore < stars {
 		return fmt.Errorf("insufficient stars: game has %d but trying to transfer %d", fromStarsBefore, stars)
 	}
 
-	_, err = tx.Exec("UPDATE games SET stars = stars - $1 WHERE id = $2", stars, fromID)
+	_, err = tx.Exec(sqlDeductStars, stars, fromID)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Deducted %d stars from game %d\n", stars, fromID)
-
-	// Operation 2: Check and add stars to target game
-	var toStarsBefore int
-	err = tx.QueryRow("SELECT stars FROM games WHERE id = $1", toID).Scan(&toStarsBefore)
-	if err != nil {
-		return err
-	}
+	logger.Info("deducted stars", "stars", stars, "game_id", fromID)
 
 	if toStarsBefore+stars > 100 {
-		log.Printf("Business rule violation: Target game has %d stars, adding %d would exceed 100\n", toStarsBefore, stars)
+		logger.Warn("business rule violation: target would exceed 100 stars", "current_stars", toStarsBefore, "adding", stars)
 		return fmt.Errorf("target game would exceed 100 stars (%d + %d = %d)", toStarsBefore, stars, toStarsBefore+stars)
 	}
 
-	_, err = tx.Exec("UPDATE games SET stars = stars + $1 WHERE id = $2", stars, toID)
+	_, err = tx.Exec(sqlAddStars, stars, toID)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Added %d stars to game %d\n", stars, toID)
+	logger.Info("added stars", "stars", stars, "game_id", toID)
+
+	// Emit notification events in the same transaction as the star change,
+	// so a crash or error after this point rolls the enqueue back too.
+	if err := enqueueInTx(tx, "email_queue", GameEvent{
+		GameID:    fromID,
+		Stars:     fromStarsBefore - stars,
+		EventType: "star_transfer_out",
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if err := enqueueInTx(tx, "email_queue", GameEvent{
+		GameID:    toID,
+		Stars:     toStarsBefore + stars,
+		EventType: "star_transfer_in",
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
 
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		return err
 	}
 
-	log.Println("Transfer transaction committed")
+	logger.Info("transfer transaction committed")
 	return nil
 }
 
+// lockGamesForUpdate locks the given game rows with SELECT ... FOR UPDATE,
+// always in ascending id order, and returns their current star counts keyed
+// by id. Locking in a fixed order regardless of the caller's fromID/toID
+// order prevents two transfers over the same pair of games from deadlocking.
+func lockGamesForUpdate(tx Tx, fromID, toID int) (map[int]int, error) {
+	ids := []int{fromID, toID}
+	if ids[0] > ids[1] {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+
+	stars := make(map[int]int, 2)
+	for _, id := range ids {
+		if _, ok := stars[id]; ok {
+			continue // fromID == toID, already locked
+		}
+		var s int
+		if err := tx.QueryRow(sqlLockGameForUpdate, id).Scan(&s); err != nil {
+			return nil, err
+		}
+		stars[id] = s
+	}
+
+	return stars, nil
+}
+
 // Transfer stars WITHOUT transaction - demonstrates data corruption
 func transferStarsWithoutTransaction(fromID, toID, stars int) error {
 	// Operation 1: Deduct stars from source game (NO TRANSACTION)
-	_, err := db.Exec("UPDATE games SET stars = stars - $1 WHERE id = $2", stars, fromID)
+	_, err := db.Exec(sqlDeductStars, stars, fromID)
 	if err != nil {
-		log.Println("Operation 1 failed:", err)
+		logger.Error("operation 1 failed", "error", err)
 		return err
 	}
-	log.Printf("Operation 1: Deducted %d stars from game %d (SAVED TO DB)\n", stars, fromID)
+	logger.Info("operation 1: deducted stars (saved to db)", "stars", stars, "game_id", fromID)
 
 	// Simulate failure BEFORE operation 2
-	log.Println("Simulated failure! Network error before adding stars to target")
+	logger.Warn("simulated failure: network error before adding stars to target")
 	return fmt.Errorf("network error before operation 2")
 
 	// Operation 2: Add stars to target game (NEVER EXECUTES)
 	// This is unreachable due to return above
-	_, err = db.Exec("UPDATE games SET stars = stars + $1 WHERE id = $2", stars, toID)
-	
+	_, err = db.Exec(sqlAddStars, stars, toID)
+
 	// Without transaction: Operation 1 already committed
 	// Stars deducted from source but never added to target
 	// Stars disappeared! Data corruption!
-	
+
 	return err
-}
\ No newline at end of file
+}
+
+// ============= BULK IMPORT =============
+
+// bulkImportGames loads rows in bulk via COPY instead of per-row
+// INSERT ... RETURNING id, for seeding catalogs or end-of-season rank
+// updates where row-by-row inserts are too slow. Rows are first streamed
+// into a temp staging table, then moved into games in a single statement
+// that enforces the 0..100 stars business rule server-side; rows that
+// violate it are rejected rather than failing the whole import. It
+// returns the number of rows inserted and the 1-based positions (in the
+// input slice) of any rejected rows. A COPY protocol error rolls back
+// the whole import, leaving games untouched.
+func bulkImportGames(rows []Game) (inserted int, rejectedRows []int, err error) {
+	if db.Driver() != "postgres" {
+		return 0, nil, fmt.Errorf("bulk import requires DB_DRIVER=postgres (uses TEMP TABLE + COPY, unsupported on %s)", db.Driver())
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TEMP TABLE games_staging (LIKE games INCLUDING ALL) ON COMMIT DROP`); err != nil {
+		return 0, nil, err
+	}
+
+	// row_num preserves input order so rejected rows can be reported back
+	// to the caller by position.
+	if _, err := tx.Exec(`ALTER TABLE games_staging ADD COLUMN row_num SERIAL`); err != nil {
+		return 0, nil, err
+	}
+
+	stmt, err := tx.Prepare(pqCopyIn("games_staging", "title", "description", "stars"))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to prepare COPY: %w", err)
+	}
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(row.Title, row.Description, row.Stars); err != nil {
+			stmt.Close()
+			return 0, nil, fmt.Errorf("COPY protocol error: %w", err)
+		}
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return 0, nil, fmt.Errorf("failed to flush COPY: %w", err)
+	}
+
+	if err := stmt.Close(); err != nil {
+		return 0, nil, fmt.Errorf("failed to close COPY statement: %w", err)
+	}
+
+	insertedRows, err := tx.Query(`
+		INSERT INTO games (title, description, stars)
+		SELECT title, description, stars FROM games_staging
+		WHERE stars BETWEEN 0 AND 100
+		RETURNING id`)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to insert from staging: %w", err)
+	}
+	for insertedRows.Next() {
+		inserted++
+	}
+	if err := insertedRows.Err(); err != nil {
+		insertedRows.Close()
+		return 0, nil, err
+	}
+	insertedRows.Close()
+
+	rejected, err := tx.Query(`SELECT row_num FROM games_staging WHERE stars NOT BETWEEN 0 AND 100 ORDER BY row_num`)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query rejected rows: %w", err)
+	}
+	defer rejected.Close()
+	for rejected.Next() {
+		var rowNum int
+		if err := rejected.Scan(&rowNum); err != nil {
+			return 0, nil, err
+		}
+		rejectedRows = append(rejectedRows, rowNum)
+	}
+	if err := rejected.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	logger.Info("bulk import complete", "inserted", inserted, "rejected", len(rejectedRows))
+	return inserted, rejectedRows, nil
+}
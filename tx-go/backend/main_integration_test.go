@@ -5,7 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
@@ -17,9 +21,9 @@ import (
 )
 
 var (
-	testDB             *sql.DB
-	postgresContainer  *testcontainerspostgres.PostgresContainer
-	testContainerCtx   context.Context
+	testDB            *sql.DB
+	postgresContainer *testcontainerspostgres.PostgresContainer
+	testContainerCtx  context.Context
 )
 
 func TestMain(m *testing.M) {
@@ -82,7 +86,7 @@ func setupTestDB(database *sql.DB) error {
 	}
 
 	m, err := migrate.NewWithDatabaseInstance(
-		"file://migrations",
+		"file://migrations/postgres",
 		"postgres", driver)
 	if err != nil {
 		return err
@@ -93,7 +97,7 @@ func setupTestDB(database *sql.DB) error {
 	if err != nil && err != migrate.ErrNilVersion {
 		return err
 	}
-	
+
 	// If database has migrations, drop them
 	if err == nil || dirty {
 		if err := m.Drop(); err != nil {
@@ -126,7 +130,7 @@ func TestIntegration_TransferStarsWithTransaction_Success(t *testing.T) {
 	}
 
 	clearTestData(t)
-	db = testDB // Use test database
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
 
 	// Arrange: Insert test games
 	var fromGameID, toGameID int
@@ -178,7 +182,7 @@ func TestIntegration_TransferStarsWithTransaction_RollbackOnInsufficientStars(t
 	}
 
 	clearTestData(t)
-	db = testDB
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
 
 	// Arrange: Insert test games
 	var fromGameID, toGameID int
@@ -225,7 +229,7 @@ func TestIntegration_TransferStarsWithTransaction_RollbackOnMaxExceeded(t *testi
 	}
 
 	clearTestData(t)
-	db = testDB
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
 
 	// Arrange: Target game near maximum
 	var fromGameID, toGameID int
@@ -272,7 +276,7 @@ func TestIntegration_TransferStarsWithoutTransaction_DataCorruption(t *testing.T
 	}
 
 	clearTestData(t)
-	db = testDB
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
 
 	// Arrange
 	var fromGameID, toGameID int
@@ -320,13 +324,129 @@ func TestIntegration_TransferStarsWithoutTransaction_DataCorruption(t *testing.T
 	}
 }
 
+func TestIntegration_TransferStarsWithTransaction_ConcurrentTransfersConserveTotal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	clearTestData(t)
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
+
+	// Arrange: two games with enough stars between them to survive N
+	// concurrent 1-star transfers without either side going negative.
+	const goroutines = 50
+	var gameAID, gameBID int
+	err := testDB.QueryRow(
+		"INSERT INTO games (title, description, stars) VALUES ($1, $2, $3) RETURNING id",
+		"Game A", "Transfers back and forth", goroutines,
+	).Scan(&gameAID)
+	if err != nil {
+		t.Fatalf("Failed to insert game A: %v", err)
+	}
+
+	err = testDB.QueryRow(
+		"INSERT INTO games (title, description, stars) VALUES ($1, $2, $3) RETURNING id",
+		"Game B", "Transfers back and forth", goroutines,
+	).Scan(&gameBID)
+	if err != nil {
+		t.Fatalf("Failed to insert game B: %v", err)
+	}
+
+	// Act: fire goroutines transferring 1 star each, alternating direction,
+	// between the same two rows. FOR UPDATE locking in ascending id order
+	// should serialize these without deadlocking.
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				transferStarsWithTransaction(gameAID, gameBID, 1)
+			} else {
+				transferStarsWithTransaction(gameBID, gameAID, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Assert: total star count is conserved and neither side went negative.
+	var starsA, starsB int
+	if err := testDB.QueryRow("SELECT stars FROM games WHERE id = $1", gameAID).Scan(&starsA); err != nil {
+		t.Fatalf("Failed to read game A stars: %v", err)
+	}
+	if err := testDB.QueryRow("SELECT stars FROM games WHERE id = $1", gameBID).Scan(&starsB); err != nil {
+		t.Fatalf("Failed to read game B stars: %v", err)
+	}
+
+	if starsA < 0 || starsB < 0 {
+		t.Errorf("Expected no negative balances, got A=%d B=%d", starsA, starsB)
+	}
+	if total := starsA + starsB; total != 2*goroutines {
+		t.Errorf("Expected total stars conserved at %d, got %d", 2*goroutines, total)
+	}
+}
+
+func TestIntegration_EnqueueInTx_RollbackLeavesQueueEmpty(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+
+	if err := enqueueInTx(tx, "email_queue", GameEvent{GameID: 1, EventType: "test", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("enqueueInTx failed: %v", err)
+	}
+
+	// Simulate a failure elsewhere in the transaction forcing a rollback.
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+
+	var msgID sql.NullInt64
+	err = testDB.QueryRow("SELECT msg_id FROM pgmq.read('email_queue', 0, 1)").Scan(&msgID)
+	if err != sql.ErrNoRows {
+		t.Errorf("Expected queue to be empty after rollback, got msg_id=%v err=%v", msgID, err)
+	}
+}
+
+func TestIntegration_EnqueueInTx_CommitLeavesOneReadableMessage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+
+	if err := enqueueInTx(tx, "email_queue", GameEvent{GameID: 1, EventType: "test", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("enqueueInTx failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	var msgID int64
+	if err := testDB.QueryRow("SELECT msg_id FROM pgmq.read('email_queue', 0, 1)").Scan(&msgID); err != nil {
+		t.Fatalf("Expected exactly one readable message after commit, got: %v", err)
+	}
+}
+
 func TestIntegration_AddStarWithTransaction_Success(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test")
 	}
 
 	clearTestData(t)
-	db = testDB
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
 
 	// Arrange: Create game 1 and target game
 	_, err := testDB.Exec(
@@ -363,4 +483,114 @@ func TestIntegration_AddStarWithTransaction_Success(t *testing.T) {
 	if targetStars != 4 {
 		t.Errorf("Expected target game to have 4 stars, got %d", targetStars)
 	}
-}
\ No newline at end of file
+}
+
+func TestIntegration_BulkImportGames_HighThroughput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	clearTestData(t)
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
+
+	const rowCount = 10_000
+	rows := make([]Game, rowCount)
+	for i := range rows {
+		rows[i] = Game{Title: fmt.Sprintf("Game %d", i), Description: "Bulk loaded", Stars: i % 101}
+	}
+
+	start := time.Now()
+	inserted, rejected, err := bulkImportGames(rows)
+	bulkElapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("bulkImportGames failed: %v", err)
+	}
+	if inserted != rowCount {
+		t.Errorf("expected %d rows inserted, got %d", rowCount, inserted)
+	}
+	if len(rejected) != 0 {
+		t.Errorf("expected no rejected rows, got %d", len(rejected))
+	}
+
+	clearTestData(t)
+
+	start = time.Now()
+	for _, row := range rows {
+		var id int
+		if err := testDB.QueryRow(
+			"INSERT INTO games (title, description, stars) VALUES ($1, $2, $3) RETURNING id",
+			row.Title, row.Description, row.Stars,
+		).Scan(&id); err != nil {
+			t.Fatalf("row-by-row insert failed: %v", err)
+		}
+	}
+	rowByRowElapsed := time.Since(start)
+
+	if bulkElapsed >= rowByRowElapsed {
+		t.Errorf("expected bulk import (%s) to be faster than row-by-row inserts (%s)", bulkElapsed, rowByRowElapsed)
+	}
+}
+
+func TestIntegration_BulkImportGames_RejectsOutOfRangeStars(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	clearTestData(t)
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
+
+	rows := []Game{
+		{Title: "Valid Low", Description: "ok", Stars: 0},
+		{Title: "Too Low", Description: "bad", Stars: -5},
+		{Title: "Valid High", Description: "ok", Stars: 100},
+		{Title: "Too High", Description: "bad", Stars: 150},
+		{Title: "Valid Mid", Description: "ok", Stars: 50},
+	}
+
+	inserted, rejected, err := bulkImportGames(rows)
+	if err != nil {
+		t.Fatalf("bulkImportGames failed: %v", err)
+	}
+	if inserted != 3 {
+		t.Errorf("expected 3 rows inserted, got %d", inserted)
+	}
+	if want := []int{2, 4}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("expected rejected rows %v, got %v", want, rejected)
+	}
+
+	var count int
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM games").Scan(&count); err != nil {
+		t.Fatalf("failed to count games: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 games in table, got %d", count)
+	}
+}
+
+func TestIntegration_BulkImportGames_RollsBackOnCopyError(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test")
+	}
+
+	clearTestData(t)
+	db = &sqlStore{db: testDB, driver: "postgres", rebind: noRebind}
+
+	// A title longer than the games.title VARCHAR(255) column triggers a
+	// COPY protocol error partway through the stream.
+	rows := []Game{
+		{Title: "Valid Game", Description: "ok", Stars: 10},
+		{Title: strings.Repeat("x", 300), Description: "too long", Stars: 10},
+	}
+
+	if _, _, err := bulkImportGames(rows); err == nil {
+		t.Fatal("expected bulkImportGames to fail on COPY protocol error")
+	}
+
+	var count int
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM games").Scan(&count); err != nil {
+		t.Fatalf("failed to count games: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("expected no games to be inserted after rollback, got %d", count)
+	}
+}
@@ -6,45 +6,63 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
-func TestTransferStarsWithTransaction_Success(t *testing.T) {
-	// Arrange
-	mockDB, mock, err := sqlmock.New()
+// newMockDB creates a sqlmock database using exact (non-regex) SQL matching,
+// points the package-level db at it, and registers cleanup. Tests can then
+// assert against the literal SQL the code executes instead of hand-escaping
+// it into a regex.
+func newMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	mockDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	if err != nil {
 		t.Fatalf("failed to create mock db: %v", err)
 	}
-	defer mockDB.Close()
+	t.Cleanup(func() { mockDB.Close() })
 
-	db = mockDB
+	db = &sqlStore{db: mockDB, driver: "postgres", rebind: noRebind}
+	return mock
+}
+
+func TestTransferStarsWithTransaction_Success(t *testing.T) {
+	// Arrange
+	mock := newMockDB(t)
 
 	fromID, toID, stars := 1, 2, 3
 
 	// Mock transaction
 	mock.ExpectBegin()
-	
-	// Mock SELECT from source game
-	mock.ExpectQuery("SELECT stars FROM games WHERE id = \\$1").
+
+	// Both rows are locked FOR UPDATE, in ascending id order, before either is updated.
+	mock.ExpectQuery(sqlLockGameForUpdate).
 		WithArgs(fromID).
 		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(10))
 
+	mock.ExpectQuery(sqlLockGameForUpdate).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(5))
+
 	// Mock UPDATE source game
-	mock.ExpectExec("UPDATE games SET stars = stars - \\$1 WHERE id = \\$2").
+	mock.ExpectExec(sqlDeductStars).
 		WithArgs(stars, fromID).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
-	// Mock SELECT target game
-	mock.ExpectQuery("SELECT stars FROM games WHERE id = \\$1").
-		WithArgs(toID).
-		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(5))
-
 	// Mock UPDATE target game
-	mock.ExpectExec("UPDATE games SET stars = stars \\+ \\$1 WHERE id = \\$2").
+	mock.ExpectExec(sqlAddStars).
 		WithArgs(stars, toID).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
+	// Mock outbox enqueue for both games
+	mock.ExpectQuery(sqlEnqueueMessage).
+		WithArgs("email_queue", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"send"}).AddRow(1))
+	mock.ExpectQuery(sqlEnqueueMessage).
+		WithArgs("email_queue", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"send"}).AddRow(2))
+
 	mock.ExpectCommit()
 
 	// Act
-	err = transferStarsWithTransaction(fromID, toID, stars)
+	err := transferStarsWithTransaction(fromID, toID, stars)
 
 	// Assert
 	if err != nil {
@@ -58,27 +76,25 @@ func TestTransferStarsWithTransaction_Success(t *testing.T) {
 
 func TestTransferStarsWithTransaction_InsufficientStars(t *testing.T) {
 	// Arrange
-	mockDB, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("failed to create mock db: %v", err)
-	}
-	defer mockDB.Close()
-
-	db = mockDB
+	mock := newMockDB(t)
 
 	fromID, toID, stars := 1, 2, 10
 
 	mock.ExpectBegin()
-	
-	// Mock SELECT from source game with insufficient stars
-	mock.ExpectQuery("SELECT stars FROM games WHERE id = \\$1").
+
+	// Both rows are locked FOR UPDATE before the balance is checked.
+	mock.ExpectQuery(sqlLockGameForUpdate).
 		WithArgs(fromID).
 		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(5))
 
+	mock.ExpectQuery(sqlLockGameForUpdate).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(0))
+
 	mock.ExpectRollback()
 
 	// Act
-	err = transferStarsWithTransaction(fromID, toID, stars)
+	err := transferStarsWithTransaction(fromID, toID, stars)
 
 	// Assert
 	if err == nil {
@@ -92,37 +108,31 @@ func TestTransferStarsWithTransaction_InsufficientStars(t *testing.T) {
 
 func TestTransferStarsWithTransaction_ExceedsMaximum(t *testing.T) {
 	// Arrange
-	mockDB, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("failed to create mock db: %v", err)
-	}
-	defer mockDB.Close()
-
-	db = mockDB
+	mock := newMockDB(t)
 
 	fromID, toID, stars := 1, 2, 10
 
 	mock.ExpectBegin()
-	
-	// Mock SELECT from source game
-	mock.ExpectQuery("SELECT stars FROM games WHERE id = \\$1").
+
+	// Mock SELECT source game FOR UPDATE
+	mock.ExpectQuery(sqlLockGameForUpdate).
 		WithArgs(fromID).
 		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(20))
 
+	// Mock SELECT target game FOR UPDATE with 95 stars (would exceed 100)
+	mock.ExpectQuery(sqlLockGameForUpdate).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(95))
+
 	// Mock UPDATE source game
-	mock.ExpectExec("UPDATE games SET stars = stars - \\$1 WHERE id = \\$2").
+	mock.ExpectExec(sqlDeductStars).
 		WithArgs(stars, fromID).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
-	// Mock SELECT target game with 95 stars (would exceed 100)
-	mock.ExpectQuery("SELECT stars FROM games WHERE id = \\$1").
-		WithArgs(toID).
-		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(95))
-
 	mock.ExpectRollback()
 
 	// Act
-	err = transferStarsWithTransaction(fromID, toID, stars)
+	err := transferStarsWithTransaction(fromID, toID, stars)
 
 	// Assert
 	if err == nil {
@@ -136,18 +146,12 @@ func TestTransferStarsWithTransaction_ExceedsMaximum(t *testing.T) {
 
 func TestTransferStarsWithoutTransaction_FailsAfterDeduction(t *testing.T) {
 	// Arrange
-	mockDB, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("failed to create mock db: %v", err)
-	}
-	defer mockDB.Close()
-
-	db = mockDB
+	mock := newMockDB(t)
 
 	fromID, toID, stars := 1, 2, 3
 
 	// Mock UPDATE source game (succeeds)
-	mock.ExpectExec("UPDATE games SET stars = stars - \\$1 WHERE id = \\$2").
+	mock.ExpectExec(sqlDeductStars).
 		WithArgs(stars, fromID).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
@@ -155,7 +159,7 @@ func TestTransferStarsWithoutTransaction_FailsAfterDeduction(t *testing.T) {
 	// No second UPDATE is expected
 
 	// Act
-	err = transferStarsWithoutTransaction(fromID, toID, stars)
+	err := transferStarsWithoutTransaction(fromID, toID, stars)
 
 	// Assert
 	if err == nil {
@@ -171,37 +175,42 @@ func TestTransferStarsWithoutTransaction_FailsAfterDeduction(t *testing.T) {
 
 func TestAddStarWithTransaction_Success(t *testing.T) {
 	// Arrange
-	mockDB, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("failed to create mock db: %v", err)
-	}
-	defer mockDB.Close()
-
-	db = mockDB
+	mock := newMockDB(t)
 
 	gameID := 2
 
 	mock.ExpectBegin()
-	
+
 	// Mock SELECT target game
-	mock.ExpectQuery("SELECT stars FROM games WHERE id = \\$1").
+	mock.ExpectQuery(sqlSelectGameStars).
 		WithArgs(gameID).
 		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(5))
 
 	// Mock UPDATE target game (deduct)
-	mock.ExpectExec("UPDATE games SET stars = stars - 1 WHERE id = \\$1").
+	mock.ExpectExec(sqlDeductOneStar).
 		WithArgs(gameID).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	// Mock UPDATE game 1 (add)
-	mock.ExpectExec("UPDATE games SET stars = stars \\+ 1 WHERE id = \\$1").
+	mock.ExpectExec(sqlAddOneStar).
 		WithArgs(1).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
+	// Mock SELECT game 1's new stars, then outbox enqueue for both games
+	mock.ExpectQuery(sqlSelectGameStars).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(1))
+	mock.ExpectQuery(sqlEnqueueMessage).
+		WithArgs("email_queue", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"send"}).AddRow(1))
+	mock.ExpectQuery(sqlEnqueueMessage).
+		WithArgs("email_queue", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"send"}).AddRow(2))
+
 	mock.ExpectCommit()
 
 	// Act
-	err = addStarWithTransaction(gameID)
+	err := addStarWithTransaction(gameID)
 
 	// Assert
 	if err != nil {
@@ -215,27 +224,21 @@ func TestAddStarWithTransaction_Success(t *testing.T) {
 
 func TestAddStarWithTransaction_NoStarsToTransfer(t *testing.T) {
 	// Arrange
-	mockDB, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("failed to create mock db: %v", err)
-	}
-	defer mockDB.Close()
-
-	db = mockDB
+	mock := newMockDB(t)
 
 	gameID := 2
 
 	mock.ExpectBegin()
-	
+
 	// Mock SELECT target game with 0 stars
-	mock.ExpectQuery("SELECT stars FROM games WHERE id = \\$1").
+	mock.ExpectQuery(sqlSelectGameStars).
 		WithArgs(gameID).
 		WillReturnRows(sqlmock.NewRows([]string{"stars"}).AddRow(0))
 
 	mock.ExpectRollback()
 
 	// Act
-	err = addStarWithTransaction(gameID)
+	err := addStarWithTransaction(gameID)
 
 	// Assert
 	if err == nil {
@@ -245,4 +248,4 @@ func TestAddStarWithTransaction_NoStarsToTransfer(t *testing.T) {
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("unfulfilled expectations: %v", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store abstracts the subset of *sql.DB the handlers and transaction demo
+// functions need, so the driver (and its placeholder style) can be swapped
+// via DB_DRIVER without touching handler code. Driver() lets callers gate
+// postgres-only features (pgmq, pq.CopyIn, FOR UPDATE locking) when running
+// against sqlite for Docker-free local dev/tests.
+type Store interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Exec(query string, args ...any) (sql.Result, error)
+	Begin() (Tx, error)
+	BeginTx(level sql.IsolationLevel) (Tx, error)
+	Driver() string
+	Ping() error
+	Close() error
+}
+
+// Tx is the transactional counterpart of Store.
+type Tx interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Exec(query string, args ...any) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Driver() string
+	Commit() error
+	Rollback() error
+}
+
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+	rebind func(string) string
+}
+
+func (s *sqlStore) Query(query string, args ...any) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *sqlStore) QueryRow(query string, args ...any) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+func (s *sqlStore) Exec(query string, args ...any) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStore) Begin() (Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx: tx, driver: s.driver, rebind: s.rebind}, nil
+}
+
+// BeginTx starts a transaction at the given isolation level, so callers
+// that need stronger guarantees than READ COMMITTED (e.g. the star
+// transfer, which must not let two concurrent serializable transactions
+// both commit against a stale read) can request sql.LevelSerializable.
+func (s *sqlStore) BeginTx(level sql.IsolationLevel) (Tx, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx: tx, driver: s.driver, rebind: s.rebind}, nil
+}
+
+func (s *sqlStore) Driver() string { return s.driver }
+func (s *sqlStore) Ping() error    { return s.db.Ping() }
+func (s *sqlStore) Close() error   { return s.db.Close() }
+
+type sqlTx struct {
+	tx     *sql.Tx
+	driver string
+	rebind func(string) string
+}
+
+func (t *sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.tx.Query(t.rebind(query), args...)
+}
+
+func (t *sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRow(t.rebind(query), args...)
+}
+
+func (t *sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.tx.Exec(t.rebind(query), args...)
+}
+
+// Prepare is used for pq.CopyIn statements, which are postgres-specific and
+// already produce driver-correct SQL, so it bypasses rebind.
+func (t *sqlTx) Prepare(query string) (*sql.Stmt, error) {
+	return t.tx.Prepare(query)
+}
+
+func (t *sqlTx) Driver() string  { return t.driver }
+func (t *sqlTx) Commit() error   { return t.tx.Commit() }
+func (t *sqlTx) Rollback() error { return t.tx.Rollback() }
+
+// dollarPlaceholder matches postgres' $1, $2, ... placeholders so they can
+// be rewritten to sqlite's positional "?".
+var dollarPlaceholder = regexp.MustCompile(`\$\d+`)
+
+func noRebind(query string) string { return query }
+
+func sqliteRebind(query string) string {
+	query = dollarPlaceholder.ReplaceAllString(query, "?")
+	// sqlite has no row-level locking; a plain SELECT already serializes
+	// behind the writer lock sqlite takes for the transaction.
+	query = stripForUpdate(query)
+	return query
+}
+
+var forUpdateSuffix = regexp.MustCompile(`\s+FOR UPDATE\s*$`)
+
+func stripForUpdate(query string) string {
+	return forUpdateSuffix.ReplaceAllString(query, "")
+}
+
+// openStore opens the database selected by DB_DRIVER ("postgres", the
+// default, or "sqlite" for a Docker-free local dev database) and returns a
+// Store plus the driver name, for picking the matching migrations
+// directory and gating postgres-only features.
+func openStore() (Store, string, error) {
+	driver := os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = "postgres"
+	}
+
+	switch driver {
+	case "postgres":
+		dbURL := os.Getenv("DATABASE_URL")
+		if dbURL == "" {
+			dbURL = "postgres://postgres:postgres@db:5432/gamedb?sslmode=disable"
+		}
+		sqlDB, err := sql.Open("postgres", dbURL)
+		if err != nil {
+			return nil, "", err
+		}
+		return &sqlStore{db: sqlDB, driver: driver, rebind: noRebind}, driver, nil
+
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "file::memory:?cache=shared"
+		}
+		sqlDB, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return nil, "", err
+		}
+		return &sqlStore{db: sqlDB, driver: driver, rebind: sqliteRebind}, driver, nil
+
+	default:
+		return nil, "", fmt.Errorf("unsupported DB_DRIVER %q (want \"postgres\" or \"sqlite\")", driver)
+	}
+}
+
+// runMigrations applies the schema for driver from migrations/<driver>, so
+// postgres and sqlite each get the DDL dialect (and extensions) they
+// understand; pgmq setup is skipped entirely on sqlite since the extension
+// doesn't exist outside postgres.
+func runMigrations(store Store, driver string) error {
+	path := fmt.Sprintf("migrations/%s/0001_init.up.sql", driver)
+
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read migration %s: %w", path, err)
+	}
+
+	if _, err := store.Exec(string(schema)); err != nil {
+		return fmt.Errorf("failed to apply migration %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// pqCopyIn is a thin indirection over pq.CopyIn so callers don't need a
+// direct postgres-specific import; it must only be used when
+// Store.Driver() == "postgres".
+func pqCopyIn(table string, columns ...string) string {
+	return pq.CopyIn(table, columns...)
+}